@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/lieberdev/go-rest-template/internal/database"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		database.UserFilter
+		database.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Email = app.readString(qs, "email", "")
+	input.Activated = app.readBool(qs, "activated", v)
+	input.Disabled = app.readBool(qs, "disabled", v)
+	input.CreatedAfter = app.readTime(qs, "created_after", v)
+	input.CreatedBefore = app.readTime(qs, "created_before", v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "created_at")
+	input.Filters.SortSafelist = []string{
+		"created_at", "email", "first_name", "last_name",
+		"-created_at", "-email", "-first_name", "-last_name",
+	}
+
+	if database.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.UserFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		FirstName *string `json:"first_name"`
+		LastName  *string `json:"last_name"`
+		Email     *string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	changed := []string{}
+	metadata := map[string]any{}
+
+	if input.FirstName != nil {
+		user.FirstName = *input.FirstName
+		changed = append(changed, "first_name")
+	}
+	if input.LastName != nil {
+		user.LastName = *input.LastName
+		changed = append(changed, "last_name")
+	}
+	if input.Email != nil && *input.Email != user.Email {
+		metadata["previous_email"] = user.Email
+		metadata["email"] = *input.Email
+		user.Email = *input.Email
+		changed = append(changed, "email")
+	}
+	metadata["fields"] = changed
+
+	app.saveUser(w, r, user, database.AuditEvent{Type: database.AuditUserUpdated, TargetID: &user.ID, Metadata: metadata})
+}
+
+func (app *application) activateUserByAdminHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	user.Activated = true
+
+	err := app.models.Tokens.DeleteAllForUser(database.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Activating is also how admins undo deactivateUserHandler.
+	err = app.models.Users.Enable(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	user.DisabledAt = nil
+
+	app.saveUser(w, r, user, database.AuditEvent{Type: database.AuditUserActivated, TargetID: &user.ID})
+}
+
+// deactivateUserHandler disables the user, which locks them out of every
+// way of signing in until an admin activates them again, signs them out
+// everywhere and revokes their OAuth grants and API keys. Flows the user
+// drives, like activation tokens, magic links or OIDC, never clear the
+// mark.
+func (app *application) deactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+
+	err := app.models.Users.Disable(user.ID, now)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	user.DisabledAt = &now
+
+	err = app.revokeAllAccess(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Type: database.AuditUserDisabled, TargetID: &user.ID})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// resetUserPasswordHandler replaces the user's password with a random one,
+// signs them out everywhere, revokes their OAuth grants and API keys and
+// emails them a password reset token.
+func (app *application) resetUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := user.Password.Set(rand.Text())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.revokeAllAccess(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.sendPasswordResetToken(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Type: database.AuditPasswordReset, TargetID: &user.ID})
+
+	env := envelope{"message": "the user's password was reset and an email will be sent to them containing password reset instructions"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// impersonateUserHandler issues a short-lived authentication token with
+// which the admin acts as the user. The token is marked with the admin's ID
+// and comes without a refresh token, so impersonating ends when it expires.
+// Other admins can't be impersonated, and the admin endpoints refuse
+// impersonation tokens in case the user is made an admin meanwhile.
+func (app *application) impersonateUserHandler(w http.ResponseWriter, r *http.Request) {
+	admin := app.contextGetUser(r)
+
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == admin.ID {
+		app.badRequestResponse(w, r, errors.New("you can't impersonate yourself"))
+		return
+	}
+
+	// Acting as another admin would hand out admin access under someone
+	// else's name.
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if permissions.Includes(database.PermissionAdmin) {
+		app.badRequestResponse(w, r, errors.New("you can't impersonate an admin"))
+		return
+	}
+
+	token, err := database.GenerateToken(user.ID, 15*time.Minute, database.ScopeAuthentication)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token.ImpersonatorID = &admin.ID
+	token.DeviceLabel = "impersonation"
+	token.UserAgent = r.UserAgent()
+	token.IPAddress = app.clientIP(r)
+
+	err = app.auth.Issue(token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.Info("impersonation started",
+		slog.String("user_id", user.ID.String()),
+		slog.String("impersonator_id", admin.ID.String()),
+	)
+
+	app.audit(r, database.AuditEvent{
+		Type:     database.AuditImpersonationStarted,
+		TargetID: &user.ID,
+		Metadata: map[string]any{"session": token.Family},
+	})
+
+	env := envelope{"authentication_token": token, "user": user}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Users.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Type: database.AuditUserDeleted, TargetID: &id})
+
+	env := envelope{"message": "user successfully deleted"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readUserParam looks up the user identified by the id URL parameter. It
+// writes the error response itself and returns false if that fails.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*database.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// saveUser validates and stores changes an admin made to a user, records the
+// audit event once they are stored and responds with the updated user.
+func (app *application) saveUser(w http.ResponseWriter, r *http.Request, user *database.User, event database.AuditEvent) {
+	v := validator.New()
+	if database.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, database.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, event)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/lieberdev/go-rest-template/internal/database"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+// audit records a security-relevant event together with the client's IP
+// address and user agent. Unless the event names an actor, the user making
+// the request is the actor. Failing to record the event is logged but
+// doesn't fail the request.
+func (app *application) audit(r *http.Request, event database.AuditEvent) {
+	if event.ActorID == nil {
+		if user := app.contextGetUser(r); !user.IsAnonymous() {
+			event.ActorID = &user.ID
+		}
+	}
+
+	if impersonator := app.contextGetImpersonator(r); impersonator != nil {
+		event.ImpersonatorID = &impersonator.ID
+	}
+
+	event.IPAddress = app.clientIP(r)
+	event.UserAgent = r.UserAgent()
+
+	err := app.models.Audit.Insert(&event)
+	if err != nil {
+		app.logger.Error("failed to record audit event",
+			slog.String("type", string(event.Type)),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+func (app *application) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		database.AuditFilter
+		database.CursorFilters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Type = database.AuditEventType(app.readString(qs, "type", ""))
+	input.ActorID = app.readUUID(qs, "actor_id", v)
+	input.TargetID = app.readUUID(qs, "target_id", v)
+	input.CreatedAfter = app.readTime(qs, "created_after", v)
+	input.CreatedBefore = app.readTime(qs, "created_before", v)
+
+	input.CursorFilters.Cursor = app.readUUID(qs, "cursor", v)
+	input.CursorFilters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	if database.ValidateCursorFilters(v, input.CursorFilters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.models.Audit.GetAll(input.AuditFilter, input.CursorFilters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/lieberdev/go-rest-template/internal/database"
+)
+
+// listenForCacheInvalidations applies the cache invalidations published by
+// other instances until the server starts shutting down, reconnecting
+// whenever the connection to the database is lost.
+func (app *application) listenForCacheInvalidations(cache *database.Cache) {
+	app.background(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go func() {
+			<-app.shutdown
+			cancel()
+		}()
+
+		for {
+			err := cache.Listen(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			app.logger.Error(err.Error())
+
+			select {
+			case <-time.After(5 * time.Second):
+			case <-app.shutdown:
+				return
+			}
+		}
+	})
+}
@@ -4,12 +4,20 @@ import (
 	"context"
 	"net/http"
 
+	"github.com/google/uuid"
 	"github.com/lieberdev/go-rest-template/internal/database"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey   = contextKey("user")
+	tokenContextKey  = contextKey("token")
+	apiKeyContextKey = contextKey("api_key")
+	oauthTokenContextKey = contextKey("oauth_token")
+	organizationContextKey = contextKey("organization")
+	impersonatorContextKey = contextKey("impersonator")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *database.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +31,73 @@ func (app *application) contextGetUser(r *http.Request) *database.User {
 	}
 	return user
 }
+
+func (app *application) contextSetToken(r *http.Request, token *database.Token) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetToken returns the authentication token the request was made
+// with, or nil for anonymous requests.
+func (app *application) contextGetToken(r *http.Request) *database.Token {
+	token, _ := r.Context().Value(tokenContextKey).(*database.Token)
+	return token
+}
+
+func (app *application) contextSetAPIKey(r *http.Request, key *database.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns the API key the request was made with, or nil if
+// the request wasn't authenticated with an API key.
+func (app *application) contextGetAPIKey(r *http.Request) *database.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*database.APIKey)
+	return key
+}
+
+func (app *application) contextSetOAuthToken(r *http.Request, token *database.OAuthToken) *http.Request {
+	ctx := context.WithValue(r.Context(), oauthTokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetOAuthToken returns the OAuth2 access token the request was made
+// with, or nil if the request wasn't made by an OAuth2 client.
+func (app *application) contextGetOAuthToken(r *http.Request) *database.OAuthToken {
+	token, _ := r.Context().Value(oauthTokenContextKey).(*database.OAuthToken)
+	return token
+}
+
+// organizationAccess is the organization a request acts in and the role
+// the user has in it.
+type organizationAccess struct {
+	OrganizationID uuid.UUID
+	Role           database.OrganizationRole
+}
+
+func (app *application) contextSetOrganization(r *http.Request, access *organizationAccess) *http.Request {
+	ctx := context.WithValue(r.Context(), organizationContextKey, access)
+	return r.WithContext(ctx)
+}
+
+// contextGetOrganization returns the organization access checked by
+// requireOrganizationRole.
+func (app *application) contextGetOrganization(r *http.Request) *organizationAccess {
+	access, ok := r.Context().Value(organizationContextKey).(*organizationAccess)
+	if !ok {
+		panic("missing organization value in request context")
+	}
+	return access
+}
+
+func (app *application) contextSetImpersonator(r *http.Request, impersonator *database.User) *http.Request {
+	ctx := context.WithValue(r.Context(), impersonatorContextKey, impersonator)
+	return r.WithContext(ctx)
+}
+
+// contextGetImpersonator returns the admin acting as the user returned by
+// contextGetUser, or nil if the request isn't made while impersonating.
+func (app *application) contextGetImpersonator(r *http.Request) *database.User {
+	impersonator, _ := r.Context().Value(impersonatorContextKey).(*database.User)
+	return impersonator
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/database"
+)
+
+const (
+	sessionCookieName = "session"
+	refreshCookieName = "refresh_token"
+	csrfCookieName    = "csrf_token"
+)
+
+// wantsCookies reports whether the client asked for the tokens of a new
+// session to be set as cookies rather than returned in the response body,
+// which it does with the X-Session-Mode: cookie header.
+func (app *application) wantsCookies(r *http.Request) bool {
+	return app.config.cookies.enabled && r.Header.Get("X-Session-Mode") == "cookie"
+}
+
+// writeTokenPair responds with the authentication and refresh token pair of
+// a session. In cookie mode both tokens go into HttpOnly cookies and the
+// body only holds the CSRF token the client has to echo back in the
+// X-CSRF-Token header of unsafe requests.
+func (app *application) writeTokenPair(w http.ResponseWriter, r *http.Request, authToken *database.Token, refreshToken *database.Token, cookies bool) {
+	env := envelope{"authentication_token": authToken, "refresh_token": refreshToken}
+
+	if cookies {
+		csrfToken := app.setSessionCookies(w, authToken, refreshToken)
+		env = envelope{"csrf_token": csrfToken, "expiry": authToken.Expiry}
+	}
+
+	err := app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setSessionCookies sets the session, refresh and CSRF cookies and returns
+// the CSRF token of the session. The refresh token is only ever sent to the
+// refresh endpoint.
+func (app *application) setSessionCookies(w http.ResponseWriter, authToken *database.Token, refreshToken *database.Token) string {
+	csrfToken := app.csrfToken(authToken.Family)
+
+	http.SetCookie(w, app.newCookie(sessionCookieName, authToken.Plaintext, "/", authToken.Expiry, true))
+	http.SetCookie(w, app.newCookie(refreshCookieName, refreshToken.Plaintext, "/tokens/refresh", refreshToken.Expiry, true))
+	http.SetCookie(w, app.newCookie(csrfCookieName, csrfToken, "/", refreshToken.Expiry, false))
+
+	return csrfToken
+}
+
+// clearSessionCookies tells the browser to drop every cookie set by
+// setSessionCookies.
+func (app *application) clearSessionCookies(w http.ResponseWriter) {
+	http.SetCookie(w, app.newCookie(sessionCookieName, "", "/", time.Unix(0, 0), true))
+	http.SetCookie(w, app.newCookie(refreshCookieName, "", "/tokens/refresh", time.Unix(0, 0), true))
+	http.SetCookie(w, app.newCookie(csrfCookieName, "", "/", time.Unix(0, 0), false))
+}
+
+func (app *application) newCookie(name string, value string, path string, expires time.Time, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   app.config.cookies.domain,
+		Expires:  expires,
+		HttpOnly: httpOnly,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// csrfToken derives the CSRF token of a session from its token family. It
+// stays the same across refreshes, and a token obtained for one session,
+// e.g. the attacker's own, is useless for any other.
+func (app *application) csrfToken(family uuid.UUID) string {
+	mac := hmac.New(sha256.New, app.config.cookies.csrfKey)
+	mac.Write(family[:])
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken reports whether the X-CSRF-Token header holds the CSRF
+// token of the session with the given family. The token is handed to the
+// client in the response body and in a cookie, neither of which other sites
+// can read.
+func (app *application) validCSRFToken(r *http.Request, family uuid.UUID) bool {
+	header := r.Header.Get("X-CSRF-Token")
+	if header == "" {
+		return false
+	}
+
+	return hmac.Equal([]byte(app.csrfToken(family)), []byte(header))
+}
+
+// isSafeMethod reports whether the request method can't change any state
+// and therefore needs no CSRF protection.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
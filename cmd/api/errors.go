@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 	"log/slog"
+	"strconv"
+	"time"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -51,6 +53,11 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+func (app *application) protectedPermissionResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the admin permission can't be deleted"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
 func (app *application) tooManyRequestsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "too many requests, please try again later"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
@@ -77,7 +84,51 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) accountDisabledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been disabled"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) sessionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key or OAuth2 token"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) impersonationForbiddenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed while impersonating a user"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) invalidCSRFTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "missing or invalid CSRF token"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) loginLockedResponse(w http.ResponseWriter, r *http.Request, lockedUntil time.Time) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(lockedUntil).Seconds())+1))
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// oauthErrorResponse writes an error in the format RFC 6749 prescribes for
+// the OAuth2 token endpoint.
+func (app *application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code string, description string) {
+	env := envelope{"error": code, "error_description": description}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	if status == http.StatusUnauthorized {
+		headers.Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+
+	err := app.writeJSON(w, status, env, headers)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
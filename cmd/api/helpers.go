@@ -5,9 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"maps"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/validator"
 )
 
 type envelope map[string]any
@@ -89,6 +97,142 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	return nil
 }
 
+// readForm parses an application/x-www-form-urlencoded request body, as
+// used by the OAuth2 endpoints, into r.PostForm.
+func (app *application) readForm(w http.ResponseWriter, r *http.Request) error {
+	maxBytes := 1_048_576
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	err := r.ParseForm()
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+		}
+		return errors.New("body contains a badly-formed form")
+	}
+
+	return nil
+}
+
+// readAuthorizationHeader splits an Authorization header into its scheme,
+// "Bearer", "ApiKey" or "Basic", and credential. Both are empty if the
+// request has no Authorization header.
+func (app *application) readAuthorizationHeader(r *http.Request) (string, string, error) {
+	authorizationHeader := r.Header.Get("Authorization")
+	if authorizationHeader == "" {
+		return "", "", nil
+	}
+
+	headerParts := strings.Split(authorizationHeader, " ")
+	if len(headerParts) != 2 || headerParts[1] == "" {
+		return "", "", errors.New("malformed authorization header")
+	}
+
+	switch headerParts[0] {
+	case "Bearer", "ApiKey", "Basic":
+		return headerParts[0], headerParts[1], nil
+	default:
+		return "", "", errors.New("unsupported authorization scheme")
+	}
+}
+
+func (app *application) readString(qs url.Values, key string, defaultValue string) string {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	return s
+}
+
+func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return defaultValue
+	}
+
+	return i
+}
+
+// readBool returns nil if the query string doesn't contain the key.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+
+	return &b
+}
+
+// readTime returns nil if the query string doesn't contain the key.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 timestamp")
+		return nil
+	}
+
+	return &t
+}
+
+// readUUID returns nil if the query string doesn't contain the key.
+func (app *application) readUUID(qs url.Values, key string, v *validator.Validator) *uuid.UUID {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	id, err := uuid.Parse(s)
+	if err != nil {
+		v.AddError(key, "must be a UUID")
+		return nil
+	}
+
+	return &id
+}
+
+func (app *application) readIDParam(r *http.Request) (uuid.UUID, error) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		return uuid.Nil, errors.New("invalid id parameter")
+	}
+	return id, nil
+}
+
+// readUUIDParam reads a UUID from the named URL parameter, for routes with
+// more than one ID in their path.
+func (app *application) readUUIDParam(r *http.Request, name string) (uuid.UUID, error) {
+	id, err := uuid.Parse(chi.URLParam(r, name))
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid %s parameter", name)
+	}
+	return id, nil
+}
+
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func (app *application) background(fn func()) {
 	app.waitgroup.Add(1)
 
@@ -104,3 +248,21 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// schedule runs fn every interval in the background until the server starts
+// shutting down.
+func (app *application) schedule(interval time.Duration, fn func()) {
+	app.background(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-app.shutdown:
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lieberdev/go-rest-template/internal/database"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+// recordLoginFailure counts a failed login, be it a wrong password or second
+// factor, against the client's IP address and, if it is known, the
+// account. When the account gets locked its owner is sent a token to unlock
+// it early.
+func (app *application) recordLoginFailure(r *http.Request, user *database.User) error {
+	_, err := app.models.Throttles.RecordFailure(database.IPThrottleKey(app.clientIP(r)), app.config.lockout.ip)
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		return nil
+	}
+
+	throttle, err := app.models.Throttles.RecordFailure(database.UserThrottleKey(user.ID), app.config.lockout.user)
+	if err != nil {
+		return err
+	}
+
+	if !throttle.Locked(time.Now()) {
+		return nil
+	}
+
+	app.logger.Warn("account locked after failed logins",
+		slog.String("user_id", user.ID.String()),
+		slog.Time("locked_until", *throttle.LockedUntil),
+	)
+
+	token, err := database.GenerateToken(user.ID, 24*time.Hour, database.ScopeUnlock)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Tokens.Insert(token)
+	if err != nil {
+		return err
+	}
+
+	app.background(func() {
+		data := map[string]any{
+			"unlockToken": token.Plaintext,
+			"lockedUntil": throttle.LockedUntil.UTC().Format(time.RFC1123),
+		}
+
+		err := app.mailer.Send(user.Email, "token_unlock.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	return nil
+}
+
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if database.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByToken(database.ScopeUnlock, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired unlock token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Throttles.Delete(database.UserThrottleKey(user.ID))
+	if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(database.ScopeUnlock, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "your account was successfully unlocked"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	throttles, err := app.models.Throttles.GetAllLocked()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"lockouts": throttles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteLockoutHandler clears the lock and failed logins of a key as listed
+// by listLockoutsHandler, e.g. "user:<id>" or "ip:<address>".
+func (app *application) deleteLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+
+	err := app.models.Throttles.Delete(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Type: database.AuditLockoutCleared, Metadata: map[string]any{"key": key}})
+
+	env := envelope{"message": "lockout successfully cleared"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/database"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+// recordLogin adds the login that starts the session to the user's history.
+// Logins from a device or IP address the user hasn't logged in from before
+// trigger an alert email with a token to report the login if it wasn't
+// them.
+func (app *application) recordLogin(r *http.Request, user *database.User, session uuid.UUID) error {
+	login := &database.LoginEvent{
+		UserID:      user.ID,
+		Session:     &session,
+		IPAddress:   app.clientIP(r),
+		UserAgent:   r.UserAgent(),
+		Fingerprint: database.DeviceFingerprint(r.UserAgent()),
+	}
+
+	err := app.models.Logins.Insert(login)
+	if err != nil {
+		return err
+	}
+
+	if !login.NewDevice {
+		return nil
+	}
+
+	token, err := database.GenerateToken(user.ID, 7*24*time.Hour, database.ScopeLoginAlert)
+	if err != nil {
+		return err
+	}
+
+	// The token's family tells reportLoginHandler which login it is about.
+	// It isn't the session's, so that revoking the session doesn't take the
+	// token with it.
+	token.Family = login.ID
+
+	err = app.models.Tokens.Insert(token)
+	if err != nil {
+		return err
+	}
+
+	app.background(func() {
+		data := map[string]any{
+			"loginTime":       login.CreatedAt.Format(time.RFC1123),
+			"ipAddress":       login.IPAddress,
+			"userAgent":       login.UserAgent,
+			"loginAlertToken": token.Plaintext,
+		}
+
+		err := app.mailer.Send(user.Email, "login_alert.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	return nil
+}
+
+func (app *application) listLoginsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var filters database.CursorFilters
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters.Cursor = app.readUUID(qs, "cursor", v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	if database.ValidateCursorFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	logins, metadata, err := app.models.Logins.GetAllForUser(user.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"logins": logins, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// reportLoginHandler handles the "this wasn't me" link of a login alert.
+// Whoever logged in may know the password, so it is replaced with a random
+// one, every session is signed out, OAuth grants and API keys are revoked
+// and the user is emailed a password reset token. Passkeys registered from
+// the reported session are deleted, and the user is emailed a list of them.
+// A pending email change is cancelled too, and a confirmed one undone, as
+// it may have been started to take over the account.
+func (app *application) reportLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if database.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.Get(database.ScopeLoginAlert, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired login alert token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Alerts sent before logins kept their session don't lead to one.
+	var session *uuid.UUID
+
+	login, err := app.models.Logins.GetForUser(token.Family, user.ID)
+	switch {
+	case err == nil:
+		session = login.Session
+	case !errors.Is(err, database.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	change, err := app.models.EmailChanges.GetForUser(user.ID)
+	switch {
+	case err == nil:
+		if change.ConfirmedAt != nil {
+			user.Email = change.OldEmail
+		}
+	case !errors.Is(err, database.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = user.Password.Set(rand.Text())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, database.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.revokeAllAccess(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	credentials := []*database.WebAuthnCredential{}
+	if session != nil {
+		credentials, err = app.models.WebAuthn.DeleteAllForSession(user.ID, *session)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.EmailChanges.DeleteForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, scope := range []database.Scope{database.ScopeLoginAlert, database.ScopeEmailChange, database.ScopeEmailChangeCancel} {
+		err = app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.sendPasswordResetToken(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if len(credentials) > 0 {
+		app.background(func() {
+			data := map[string]any{
+				"credentials": credentials,
+			}
+
+			err := app.mailer.Send(user.Email, "login_reported_passkeys.tmpl", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	}
+
+	metadata := map[string]any{"login": token.Family, "passkeys_deleted": len(credentials)}
+	if change != nil {
+		metadata["email_change_cancelled"] = change.NewEmail
+	}
+
+	app.audit(r, database.AuditEvent{
+		Type:     database.AuditLoginReported,
+		ActorID:  &user.ID,
+		TargetID: &user.ID,
+		Metadata: metadata,
+	})
+
+	env := envelope{"message": "you have been signed out everywhere, your API keys and any passkeys added during that sign-in have been revoked and an email will be sent to you containing password reset instructions"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
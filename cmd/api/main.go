@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/hex"
+	"errors"
 	"expvar"
 	"flag"
 	"log/slog"
@@ -10,8 +12,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/lieberdev/go-rest-template/internal/auth"
 	"github.com/lieberdev/go-rest-template/internal/database"
 	"github.com/lieberdev/go-rest-template/internal/mailer"
+	"github.com/lieberdev/go-rest-template/internal/oidc"
+	"github.com/lieberdev/go-rest-template/internal/policy"
+	"github.com/lieberdev/go-rest-template/internal/webauthn"
 )
 
 type config struct {
@@ -22,6 +28,35 @@ type config struct {
 	}
 	smtp mailer.Config
 	db database.Config
+	auth auth.Config
+	mfa struct {
+		issuer        string
+		encryptionKey []byte
+	}
+	webauthn webauthn.Config
+	oidc struct {
+		configPath string
+	}
+	cookies struct {
+		enabled bool
+		domain  string
+		csrfKey []byte
+	}
+	deletion struct {
+		gracePeriod time.Duration
+	}
+	lockout struct {
+		user database.ThrottlePolicy
+		ip   database.ThrottlePolicy
+	}
+	roles struct {
+		defaults []string
+	}
+	cache database.CacheConfig
+	policy struct {
+		path string
+		log  bool
+	}
 }
 
 type application struct {
@@ -29,6 +64,11 @@ type application struct {
 	logger     *slog.Logger
 	mailer     *mailer.Mailer
 	models     database.Models
+	auth       auth.Strategy
+	oidc       map[string]*oidc.Provider
+	policies   *policy.Engine
+	sessions   *sessionTracker
+	shutdown   chan struct{}
 	waitgroup  sync.WaitGroup
 }
 
@@ -65,14 +105,103 @@ func main() {
 			return nil
 		},
 	)
+	// Authentication tokens
+	flag.StringVar(&cfg.auth.Strategy, "token-strategy", "opaque", "Authentication token format (opaque|paseto)")
+	flag.Func(
+		"token-keys",
+		"PASETO keys as id:hex-secret pairs (space separated, the first key signs new tokens)",
+		func(val string) error {
+			for _, field := range strings.Fields(val) {
+				key, err := auth.ParseKey(field)
+				if err != nil {
+					return err
+				}
+				cfg.auth.Keys = append(cfg.auth.Keys, key)
+			}
+			return nil
+		},
+	)
+	flag.BoolVar(&cfg.auth.Denylist, "token-denylist", true, "Check revoked PASETO token families against a denylist")
+	// Two-factor authentication
+	flag.StringVar(&cfg.mfa.issuer, "mfa-issuer", "go-rest-template", "Issuer name shown in authenticator apps")
+	flag.Func(
+		"mfa-encryption-key",
+		"Hex encoded 32 byte key used to encrypt TOTP secrets",
+		func(val string) error {
+			key, err := hex.DecodeString(val)
+			if err != nil || len(key) != 32 {
+				return errors.New("must be 32 hex encoded bytes")
+			}
+			cfg.mfa.encryptionKey = key
+			return nil
+		},
+	)
+	// WebAuthn
+	flag.StringVar(&cfg.webauthn.RPID, "webauthn-rp-id", "localhost", "WebAuthn relying party ID (the site's domain)")
+	flag.StringVar(&cfg.webauthn.RPName, "webauthn-rp-name", "go-rest-template", "WebAuthn relying party display name")
+	flag.Func(
+		"webauthn-origins",
+		"Origins WebAuthn ceremonies may come from (space separated, passkeys are disabled without one)",
+		func(val string) error {
+			cfg.webauthn.Origins = strings.Fields(val)
+			return nil
+		},
+	)
+	// OpenID Connect
+	flag.StringVar(&cfg.oidc.configPath, "oidc-config", "", "Path to a JSON file configuring OpenID Connect providers")
+	// Cookie sessions
+	flag.BoolVar(&cfg.cookies.enabled, "cookie-sessions", false, "Allow browser clients to keep their session in cookies")
+	flag.StringVar(&cfg.cookies.domain, "cookie-domain", "", "Domain attribute of session cookies (defaults to the API host)")
+	flag.Func(
+		"cookie-csrf-key",
+		"Hex encoded 32 byte key CSRF tokens of cookie sessions are derived from",
+		func(val string) error {
+			key, err := hex.DecodeString(val)
+			if err != nil || len(key) != 32 {
+				return errors.New("must be 32 hex encoded bytes")
+			}
+			cfg.cookies.csrfKey = key
+			return nil
+		},
+	)
+	// Account deletion
+	flag.DurationVar(&cfg.deletion.gracePeriod, "deletion-grace-period", 30*24*time.Hour, "Time between a user deleting their account and the data being removed")
+	// Login lockout
+	flag.IntVar(&cfg.lockout.user.Threshold, "lockout-threshold", 5, "Failed logins before an account is locked")
+	flag.IntVar(&cfg.lockout.ip.Threshold, "lockout-ip-threshold", 20, "Failed logins before a client IP address is locked")
+	flag.DurationVar(&cfg.lockout.user.Duration, "lockout-duration", 15*time.Minute, "Duration of the first lockout, doubled on every further one")
+	flag.DurationVar(&cfg.lockout.user.MaxDuration, "lockout-max-duration", 24*time.Hour, "Maximum duration of a lockout")
+	flag.DurationVar(&cfg.lockout.user.Window, "lockout-window", time.Hour, "Time after which failed logins are forgotten")
+	// Cache
+	flag.IntVar(&cfg.cache.Size, "cache-size", 10000, "Maximum number of cached sessions and permission sets each (0 disables caching)")
+	flag.DurationVar(&cfg.cache.TTL, "cache-ttl", 30*time.Second, "Time for which sessions and permissions are cached (0 disables caching)")
+	flag.BoolVar(&cfg.cache.Notify, "cache-notify", false, "Share cache invalidations between instances through Postgres LISTEN/NOTIFY")
+	// Policies
+	flag.StringVar(&cfg.policy.path, "policy-file", "", "Path to a JSON file with authorization policies to add to the defaults")
+	flag.BoolVar(&cfg.policy.log, "policy-log", false, "Log every authorization policy decision")
+	// Roles
+	flag.Func(
+		"default-roles",
+		"Roles given to newly registered users (space separated)",
+		func(val string) error {
+			cfg.roles.defaults = strings.Fields(val)
+			return nil
+		},
+	)
 	flag.Parse()
 
+	cfg.lockout.ip.Duration = cfg.lockout.user.Duration
+	cfg.lockout.ip.MaxDuration = cfg.lockout.user.MaxDuration
+	cfg.lockout.ip.Window = cfg.lockout.user.Window
+
 	// Check if required flags are set
 	missing := []string{}
 	if cfg.smtp.Host == "" { missing = append(missing, "--smtp-host") }
 	if cfg.smtp.Username == "" { missing = append(missing, "--smtp-username") }
 	if cfg.smtp.Password == "" { missing = append(missing, "--smtp-password") }
 	if cfg.smtp.Sender == "" { missing = append(missing, "--smtp-sender") }
+	if cfg.mfa.encryptionKey == nil { missing = append(missing, "--mfa-encryption-key") }
+	if cfg.cookies.enabled && cfg.cookies.csrfKey == nil { missing = append(missing, "--cookie-csrf-key") }
 	if len(missing) > 0 {
 		slog.Error("missing required flags: " + strings.Join(missing, ", "))
 		os.Exit(1)
@@ -106,11 +235,79 @@ func main() {
 		return time.Now().Unix()
 	}))
 
+	providers := map[string]*oidc.Provider{}
+	if cfg.oidc.configPath != "" {
+		providerConfigs, err := oidc.LoadConfig(cfg.oidc.configPath)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		for _, providerConfig := range providerConfigs {
+			providers[providerConfig.Name] = oidc.NewProvider(providerConfig)
+		}
+	}
+
+	policies := defaultPolicies()
+	if cfg.policy.path != "" {
+		filePolicies, err := policy.LoadFile(cfg.policy.path)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		policies = append(policies, filePolicies...)
+	}
+
+	var policyLogger *slog.Logger
+	if cfg.policy.log {
+		policyLogger = logger
+	}
+
+	cache := database.NewCache(db, cfg.cache)
+
+	// Publish the cache hit and miss counts.
+	expvar.Publish("cache", expvar.Func(func() any {
+		return cache.Stats()
+	}))
+
+	models := database.NewModels(db, cache)
+
+	authStrategy, err := auth.New(cfg.auth, models)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
 	app := &application{
 		config: cfg,
 		logger: logger,
-		models: database.NewModels(db),
+		models: models,
+		auth: authStrategy,
+		oidc: providers,
+		policies: policy.New(policyLogger, policies...),
 		mailer: mailer,
+		sessions: newSessionTracker(),
+		shutdown: make(chan struct{}),
+	}
+
+	if cfg.cache.Notify {
+		app.listenForCacheInvalidations(cache)
+	}
+
+	app.schedule(time.Minute, app.flushSessionActivity)
+	app.schedule(time.Hour, app.deleteScheduledUsers)
+	app.schedule(time.Hour, func() {
+		err := app.models.Throttles.DeleteExpired(time.Now().Add(-cfg.lockout.user.MaxDuration))
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+	if cfg.auth.Strategy == "paseto" && cfg.auth.Denylist {
+		app.schedule(time.Hour, func() {
+			err := app.models.Denylist.DeleteExpired()
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
 	}
 
 	err = app.serve()
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lieberdev/go-rest-template/internal/auth"
+	"github.com/lieberdev/go-rest-template/internal/database"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+func (app *application) createTOTPEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if user.MFAEnabled {
+		v := validator.New()
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	encryptedSecret, err := app.encryptTOTPSecret(secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.MFA.SetTOTPSecret(user.ID, encryptedSecret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"totp": map[string]string{
+		"secret":           auth.EncodeTOTPSecret(secret),
+		"provisioning_uri": auth.TOTPProvisioningURI(app.config.mfa.issuer, user.Email, secret),
+	}}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmTOTPEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	if auth.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	totp, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			v.AddError("code", "no two-factor enrollment has been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if totp.Enabled {
+		v.AddError("code", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ok, err := app.checkTOTPCode(user, totp, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		v.AddError("code", "invalid two-factor authentication code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, hashes, err := database.GenerateRecoveryCodes(10)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.MFA.EnableTOTP(user.ID, hashes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Type: database.AuditMFAEnabled, TargetID: &user.ID, Metadata: map[string]any{"method": "totp"}})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteTOTPHandler turns two-factor authentication off, or cancels an
+// enrollment that hasn't been confirmed yet. Once it is enabled, a current
+// code is required along with the password, so that the password alone
+// can't remove the second factor.
+func (app *application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if database.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	totp, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			v.AddError("totp", "two-factor authentication is not enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if totp.Enabled {
+		if auth.ValidateTOTPCode(v, input.Code); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if totp.Enabled {
+		ok, err := app.checkTOTPCode(user, totp, input.Code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !ok {
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+	}
+
+	err = app.models.MFA.DisableTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Cancelling an enrollment that was never confirmed changes nothing
+	// worth recording.
+	if totp.Enabled {
+		app.audit(r, database.AuditEvent{Type: database.AuditMFADisabled, TargetID: &user.ID, Metadata: map[string]any{"method": "totp"}})
+	}
+
+	env := envelope{"message": "two-factor authentication has been disabled"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	database.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if input.RecoveryCode == "" {
+		auth.ValidateTOTPCode(v, input.Code)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The token is spent before the code is checked, so that a wrong guess
+	// sends the client back to the first factor instead of leaving the token
+	// open to more guesses.
+	token, err := app.models.Tokens.Consume(database.ScopeMFAPending, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound), errors.Is(err, database.ErrTokenReused):
+			v.AddError("token", "invalid or expired two-factor authentication token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired two-factor authentication token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Disabled() {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	lockedUntil, err := app.models.Throttles.LockedUntil(database.UserThrottleKey(user.ID))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !lockedUntil.IsZero() {
+		app.loginLockedResponse(w, r, lockedUntil)
+		return
+	}
+
+	var ok bool
+
+	if input.RecoveryCode != "" {
+		code := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(input.RecoveryCode))
+
+		err = app.models.MFA.ConsumeRecoveryCode(user.ID, code)
+		switch {
+		case err == nil:
+			ok = true
+		case !errors.Is(err, database.ErrRecordNotFound):
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		// Two-factor authentication may have been turned off since the
+		// first factor was checked, and a new enrollment started meanwhile
+		// isn't confirmed.
+		totp, err := app.models.MFA.GetTOTP(user.ID)
+		switch {
+		case err == nil && totp.Enabled:
+			ok, err = app.checkTOTPCode(user, totp, input.Code)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		case err != nil && !errors.Is(err, database.ErrRecordNotFound):
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !ok {
+		err = app.recordLoginFailure(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		method := "totp"
+		if input.RecoveryCode != "" {
+			method = "recovery_code"
+		}
+		app.audit(r, database.AuditEvent{
+			Type:     database.AuditMFAFailed,
+			TargetID: &user.ID,
+			Metadata: map[string]any{"method": method},
+		})
+
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.Throttles.Delete(database.UserThrottleKey(user.ID))
+	if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.completeAuthentication(w, r, user, token.DeviceLabel)
+}
+
+// checkTOTPCode validates a code against the user's TOTP secret and records
+// its time step, so the same code can't be used twice.
+func (app *application) checkTOTPCode(user *database.User, totp *database.TOTP, code string) (bool, error) {
+	secret, err := auth.Decrypt(app.config.mfa.encryptionKey, totp.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := auth.ValidateTOTP(secret, code, time.Now(), totp.LastStep)
+	if !ok {
+		return false, nil
+	}
+
+	err = app.models.MFA.UseTOTPStep(user.ID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrEditConflict):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (app *application) encryptTOTPSecret(secret []byte) ([]byte, error) {
+	return auth.Encrypt(app.config.mfa.encryptionKey, secret)
+}
@@ -5,12 +5,14 @@ import (
 	"expvar"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/felixge/httpsnoop"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/lieberdev/go-rest-template/internal/auth"
 	"github.com/lieberdev/go-rest-template/internal/database"
 	"github.com/lieberdev/go-rest-template/internal/validator"
 )
@@ -35,32 +37,42 @@ func (app *application) Logger(next http.Handler) http.Handler {
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "Cookie")
 
-		authorizationHeader := r.Header.Get("Authorization")
-		if authorizationHeader == "" {
-			r = app.contextSetUser(r, database.AnonymousUser)
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		scheme, token, err := app.readAuthorizationHeader(r)
+		if err != nil {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		token := headerParts[1]
+		// The CSRF token of unsafe cookie requests belongs to the session, so
+		// it is checked once the session is known.
+		fromCookie := false
+		if scheme == "" && app.config.cookies.enabled {
+			if cookie, err := r.Cookie(sessionCookieName); err == nil {
+				scheme, token, fromCookie = "Bearer", cookie.Value, true
+			}
+		}
 
-		v := validator.New()
-		if database.ValidateTokenPlaintext(v, token); !v.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
+		switch {
+		case scheme == "", scheme == "Basic":
+			// Basic credentials are only used by OAuth2 clients, which the
+			// OAuth2 endpoints authenticate themselves.
+			r = app.contextSetUser(r, database.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		case scheme == "ApiKey":
+			app.authenticateAPIKey(w, r, token, next)
+			return
+		case !fromCookie && strings.HasPrefix(token, database.OAuthAccessTokenPrefix):
+			app.authenticateOAuthToken(w, r, token, next)
 			return
 		}
 
-		user, err := app.models.Users.GetByToken(database.ScopeAuthentication, token)
+		user, authToken, err := app.auth.Authenticate(token)
 		if err != nil {
 			switch {
-			case errors.Is(err, database.ErrRecordNotFound):
+			case errors.Is(err, auth.ErrInvalidToken):
 				app.invalidAuthenticationTokenResponse(w, r)
 			default:
 				app.serverErrorResponse(w, r, err)
@@ -68,12 +80,77 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		if fromCookie && !isSafeMethod(r.Method) && !app.validCSRFToken(r, authToken.Family) {
+			app.invalidCSRFTokenResponse(w, r)
+			return
+		}
+
+		if authToken.ImpersonatorID != nil {
+			impersonator, err := app.models.Users.Get(*authToken.ImpersonatorID)
+			if err != nil {
+				switch {
+				case errors.Is(err, database.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			r = app.contextSetImpersonator(r, impersonator)
+		}
+
+		app.sessions.touch(authToken.Family, r.UserAgent(), app.clientIP(r))
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, authToken)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, keyPlaintext string, next http.Handler) {
+	v := validator.New()
+	if database.ValidateAPIKeyPlaintext(v, keyPlaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	user, key, err := app.models.APIKeys.GetUserByKey(keyPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
+func (app *application) authenticateOAuthToken(w http.ResponseWriter, r *http.Request, tokenPlaintext string, next http.Handler) {
+	user, token, err := app.models.OAuth.GetUserByAccessToken(tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetOAuthToken(r, token)
+
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -98,16 +175,45 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 }
 
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requireAllPermissions([]string{code}, next)
+}
+
+// requireAnyPermission lets the request through if the user has at least
+// one of the permissions.
+func (app *application) requireAnyPermission(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requirePermissions(next, func(permissions permissionCheck) bool {
+		return slices.ContainsFunc(codes, permissions)
+	})
+}
+
+// requireAllPermissions lets the request through only if the user has
+// every one of the permissions.
+func (app *application) requireAllPermissions(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requirePermissions(next, func(permissions permissionCheck) bool {
+		for _, code := range codes {
+			if !permissions(code) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// permissionCheck reports whether the request is permitted to use the
+// permission with the given code.
+type permissionCheck func(code string) bool
+
+func (app *application) requirePermissions(next http.HandlerFunc, permitted func(permissionCheck) bool) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.permissionCheck(r, user)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 
-		if !permissions.Includes(code) {
+		if !permitted(permissions) {
 			app.notPermittedResponse(w, r)
 			return
 		}
@@ -117,6 +223,82 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// permissionCheck loads the user's permissions once for checking any
+// number of codes. Requests made with an API key or an OAuth2 access token
+// are further limited to the permissions of that key or the scopes of that
+// token.
+func (app *application) permissionCheck(r *http.Request, user *database.User) (permissionCheck, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	key := app.contextGetAPIKey(r)
+	token := app.contextGetOAuthToken(r)
+
+	return func(code string) bool {
+		if key != nil && !key.Permissions.Includes(code) {
+			return false
+		}
+
+		if token != nil && !token.Scopes.Includes(code) {
+			return false
+		}
+
+		return permissions.Includes(code)
+	}, nil
+}
+
+// requireSession rejects requests that weren't made with a session token,
+// e.g. so that an API key or OAuth2 client can't be used to manage sessions
+// or other keys.
+func (app *application) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetToken(r) == nil {
+			app.sessionRequiredResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return app.requireAuthenticatedUser(fn)
+}
+
+// logImpersonation logs every request made while impersonating a user with
+// both the impersonated user and the admin acting as them.
+func (app *application) logImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		impersonator := app.contextGetImpersonator(r)
+		if impersonator == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		defer func() {
+			app.logger.Info("impersonated request",
+				slog.String("method", r.Method),
+				slog.String("url", r.RequestURI),
+				slog.Int("status", ww.Status()),
+				slog.String("user_id", app.contextGetUser(r).ID.String()),
+				slog.String("impersonator_id", impersonator.ID.String()),
+			)
+		}()
+		next.ServeHTTP(ww, r)
+	})
+}
+
+// forbidImpersonation blocks sensitive endpoints, such as changing the
+// password or managing credentials, for admins impersonating a user.
+func (app *application) forbidImpersonation(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetImpersonator(r) != nil {
+			app.impersonationForbiddenResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) metrics(next http.Handler) http.Handler {
 	totalRequestsReceived := expvar.NewInt("total_requests_received")
 	totalResponsesSent := expvar.NewInt("total_responses_sent")
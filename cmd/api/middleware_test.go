@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/database"
+)
+
+// TestRequirePermissions needs a migrated database, whose DSN it reads from
+// TEST_DB_DSN. It is skipped without one.
+func TestRequirePermissions(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN not set")
+	}
+
+	db, err := database.Init(&database.Config{Dsn: dsn, MaxOpenConns: 2, MaxIdleTime: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	app := &application{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		models: database.NewModels(db, nil),
+	}
+
+	// The codes are unique to the test run so that it doesn't clash with
+	// permissions that already exist.
+	prefix := "test" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	read := prefix + ":read"
+	write := prefix + ":write"
+
+	for _, code := range []string{read, write, prefix + ":*"} {
+		permission := &database.Permission{Code: code}
+		err = app.models.Permissions.Insert(permission)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { app.models.Permissions.Delete(permission.ID) })
+	}
+
+	newUser := func(activated bool, codes ...string) *database.User {
+		user := &database.User{
+			FirstName: "Permission",
+			LastName:  "Test",
+			Email:     uuid.NewString() + "@example.com",
+			Activated: activated,
+		}
+		err := user.Password.Set("pa55word1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = app.models.Users.Insert(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { app.models.Users.Delete(user.ID) })
+
+		err = app.models.Permissions.InsertForUser(user.ID, codes...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+
+	reader := newUser(true, read)
+	writer := newUser(true, read, write)
+	wildcard := newUser(true, prefix+":*")
+	admin := newUser(true, database.PermissionAdmin)
+	inactive := newUser(false, read, write)
+
+	anyOf := func(codes ...string) func(http.HandlerFunc) http.HandlerFunc {
+		return func(next http.HandlerFunc) http.HandlerFunc { return app.requireAnyPermission(codes, next) }
+	}
+	allOf := func(codes ...string) func(http.HandlerFunc) http.HandlerFunc {
+		return func(next http.HandlerFunc) http.HandlerFunc { return app.requireAllPermissions(codes, next) }
+	}
+
+	tests := []struct {
+		name    string
+		require func(http.HandlerFunc) http.HandlerFunc
+		user    *database.User
+		key     *database.APIKey
+		status  int
+	}{
+		{"any with one of them", anyOf(read, write), reader, nil, http.StatusOK},
+		{"any with none of them", anyOf(write), reader, nil, http.StatusForbidden},
+		{"all with every one", allOf(read, write), writer, nil, http.StatusOK},
+		{"all with only some", allOf(read, write), reader, nil, http.StatusForbidden},
+		{"all with a wildcard", allOf(read, write), wildcard, nil, http.StatusOK},
+		{"any with a wildcard", anyOf(write), wildcard, nil, http.StatusOK},
+		{"all with admin", allOf(read, write, prefix+":*"), admin, nil, http.StatusOK},
+		{"any with admin", anyOf(write), admin, nil, http.StatusOK},
+		{"wildcard requested from a code", anyOf(prefix + ":*"), writer, nil, http.StatusForbidden},
+		{"wildcard requested from the wildcard", allOf(prefix + ":*"), wildcard, nil, http.StatusOK},
+		{"key limits all", allOf(read, write), writer, &database.APIKey{Permissions: database.Permissions{read}}, http.StatusForbidden},
+		{"key limits any", anyOf(write), writer, &database.APIKey{Permissions: database.Permissions{read}}, http.StatusForbidden},
+		{"key within the user's permissions", anyOf(read, write), writer, &database.APIKey{Permissions: database.Permissions{read}}, http.StatusOK},
+		{"key doesn't extend the user's permissions", anyOf(write), reader, &database.APIKey{Permissions: database.Permissions{write}}, http.StatusForbidden},
+		{"inactive user", anyOf(read), inactive, nil, http.StatusForbidden},
+		{"anonymous user", anyOf(read), database.AnonymousUser, nil, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r = app.contextSetUser(r, tt.user)
+			if tt.key != nil {
+				r = app.contextSetAPIKey(r, tt.key)
+			}
+
+			w := httptest.NewRecorder()
+			tt.require(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}).ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d; want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/database"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+func (app *application) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if input.RedirectURIs == nil {
+		input.RedirectURIs = []string{}
+	}
+	if input.Scopes == nil {
+		input.Scopes = []string{}
+	}
+
+	client := &database.OAuthClient{
+		UserID:       user.ID,
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+	}
+
+	if input.Confidential {
+		err = client.GenerateSecret()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	v := validator.New()
+	if database.ValidateOAuthClient(v, client, permissions); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.OAuth.InsertClient(client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"oauth_client": client}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	clients, err := app.models.OAuth.GetClientsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"oauth_clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.OAuth.DeleteClientForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"message": "OAuth client and all of its tokens successfully deleted"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authorizationRequest holds the parameters of an OAuth2 authorization
+// request. Our frontend passes them on after showing the user a consent
+// screen, as we don't render any pages ourselves.
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// showOAuthAuthorizationHandler validates an authorization request and
+// returns what the consent screen needs to show the user.
+func (app *application) showOAuthAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	req := &authorizationRequest{
+		ResponseType:        qs.Get("response_type"),
+		ClientID:            qs.Get("client_id"),
+		RedirectURI:         qs.Get("redirect_uri"),
+		Scope:               qs.Get("scope"),
+		State:               qs.Get("state"),
+		CodeChallenge:       qs.Get("code_challenge"),
+		CodeChallengeMethod: qs.Get("code_challenge_method"),
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	client, scopes, err := app.validateAuthorizationRequest(v, user, req)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{
+		"client":       envelope{"client_id": client.ID, "name": client.Name},
+		"redirect_uri": req.RedirectURI,
+		"scopes":       scopes,
+	}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createOAuthAuthorizationHandler records the user's consent to an
+// authorization request and returns the URL to send the user back to the
+// client with.
+func (app *application) createOAuthAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	var req authorizationRequest
+
+	err := app.readJSON(w, r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	client, scopes, err := app.validateAuthorizationRequest(v, user, &req)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	code, err := database.GenerateOAuthCode(client.ID, user.ID, req.RedirectURI, scopes, req.CodeChallenge, 5*time.Minute)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.OAuth.InsertCode(code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	redirectURI, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	qs := redirectURI.Query()
+	qs.Set("code", code.Plaintext)
+	if req.State != "" {
+		qs.Set("state", req.State)
+	}
+	redirectURI.RawQuery = qs.Encode()
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"redirect_uri": redirectURI.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// validateAuthorizationRequest checks an authorization request, filling in
+// the redirect URI if the client only has one, and returns the client and
+// the scopes to grant. Every client must use PKCE with the S256 method.
+func (app *application) validateAuthorizationRequest(v *validator.Validator, user *database.User, req *authorizationRequest) (*database.OAuthClient, database.Permissions, error) {
+	v.Check(req.ResponseType == "code", "response_type", "must be code")
+	v.Check(req.CodeChallengeMethod == "S256", "code_challenge_method", "must be S256")
+	v.Check(len(req.CodeChallenge) == 43, "code_challenge", "must be a base64url-encoded SHA-256 hash")
+
+	clientID, err := uuid.Parse(req.ClientID)
+	if err != nil {
+		v.AddError("client_id", "must be a valid client id")
+		return nil, nil, nil
+	}
+
+	client, err := app.models.OAuth.GetClient(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			v.AddError("client_id", "must be a valid client id")
+			return nil, nil, nil
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	v.Check(client.HasRedirectURI(req.RedirectURI), "redirect_uri", "must be registered for the client")
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scopes, ok := narrowScopes(req.Scope, grantableScopes(client, permissions))
+	v.Check(ok, "scope", "must only contain scopes the client and you both have")
+
+	return client, scopes, nil
+}
+
+// grantableScopes returns the scopes of the client that the user also holds
+// as permissions.
+func grantableScopes(client *database.OAuthClient, permissions database.Permissions) database.Permissions {
+	scopes := database.Permissions{}
+	for _, code := range client.Scopes {
+		if permissions.Includes(code) {
+			scopes = append(scopes, code)
+		}
+	}
+	return scopes
+}
+
+// narrowScopes parses a space-separated scope parameter. An empty parameter
+// asks for every allowed scope; ok is false if it names any other scope.
+func narrowScopes(scope string, allowed database.Permissions) (database.Permissions, bool) {
+	if scope == "" {
+		return allowed, true
+	}
+
+	scopes := database.Permissions{}
+	for _, code := range strings.Fields(scope) {
+		if !allowed.Includes(code) {
+			return nil, false
+		}
+		if !scopes.Includes(code) {
+			scopes = append(scopes, code)
+		}
+	}
+
+	return scopes, true
+}
+
+// authenticateOAuthClient authenticates the client making a request to one
+// of the OAuth2 endpoints, either through HTTP Basic authentication or the
+// client_id and client_secret form fields. Public clients only send their
+// id. It returns nil if the client couldn't be authenticated.
+func (app *application) authenticateOAuthClient(r *http.Request) (*database.OAuthClient, error) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	id, err := uuid.Parse(clientID)
+	if err != nil {
+		return nil, nil
+	}
+
+	client, err := app.models.OAuth.GetClient(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	if client.Confidential && !client.MatchesSecret(secret) {
+		return nil, nil
+	}
+	if !client.Confidential && secret != "" {
+		return nil, nil
+	}
+
+	return client, nil
+}
+
+// readOAuthRequest parses the form of a request to one of the OAuth2
+// endpoints and authenticates its client, writing an error response and
+// returning nil if either fails.
+func (app *application) readOAuthRequest(w http.ResponseWriter, r *http.Request) *database.OAuthClient {
+	err := app.readForm(w, r)
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+		return nil
+	}
+
+	client, err := app.authenticateOAuthClient(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil
+	}
+
+	if client == nil {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil
+	}
+
+	return client
+}
+
+func (app *application) createOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	client := app.readOAuthRequest(w, r)
+	if client == nil {
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		app.exchangeOAuthCode(w, r, client)
+	case "client_credentials":
+		app.grantOAuthClientCredentials(w, r, client)
+	case "refresh_token":
+		app.refreshOAuthToken(w, r, client)
+	case "":
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "grant_type must be provided")
+	default:
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "the grant type is not supported")
+	}
+}
+
+func (app *application) exchangeOAuthCode(w http.ResponseWriter, r *http.Request, client *database.OAuthClient) {
+	code, err := app.models.OAuth.ConsumeCode(client.ID, r.PostForm.Get("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the authorization code is invalid or has expired")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if redirectURI := r.PostForm.Get("redirect_uri"); redirectURI != "" && redirectURI != code.RedirectURI {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the redirect URI doesn't match the authorization request")
+		return
+	}
+
+	if !code.MatchesVerifier(r.PostForm.Get("code_verifier")) {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the code verifier doesn't match the code challenge")
+		return
+	}
+
+	family := uuid.Must(uuid.NewV7())
+
+	accessToken, err := app.createOAuthToken(database.OAuthAccessToken, client, code.UserID, code.Scopes, family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	refreshToken, err := app.createOAuthToken(database.OAuthRefreshToken, client, code.UserID, code.Scopes, family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeOAuthTokenResponse(w, r, accessToken, refreshToken)
+}
+
+// grantOAuthClientCredentials lets a confidential client act as the user who
+// registered it. As the client can always authenticate again, it doesn't get
+// a refresh token.
+func (app *application) grantOAuthClientCredentials(w http.ResponseWriter, r *http.Request, client *database.OAuthClient) {
+	if !client.Confidential {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unauthorized_client", "public clients can't use the client credentials grant")
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(client.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	scopes, ok := narrowScopes(r.PostForm.Get("scope"), grantableScopes(client, permissions))
+	if !ok {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "the requested scope exceeds the scopes of the client")
+		return
+	}
+
+	accessToken, err := app.createOAuthToken(database.OAuthAccessToken, client, client.UserID, scopes, uuid.Must(uuid.NewV7()))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeOAuthTokenResponse(w, r, accessToken, nil)
+}
+
+func (app *application) refreshOAuthToken(w http.ResponseWriter, r *http.Request, client *database.OAuthClient) {
+	token, err := app.models.OAuth.ConsumeRefreshToken(client.ID, r.PostForm.Get("refresh_token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the refresh token is invalid or has expired")
+		case errors.Is(err, database.ErrTokenReused):
+			app.logger.Warn("OAuth refresh token reused, grant revoked",
+				slog.String("client_id", client.ID.String()),
+				slog.String("family", token.Family.String()),
+			)
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the refresh token is invalid or has expired")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The access token may be narrowed down, but the new refresh token keeps
+	// the scopes of the original grant.
+	scopes, ok := narrowScopes(r.PostForm.Get("scope"), token.Scopes)
+	if !ok {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "the requested scope exceeds the scope of the grant")
+		return
+	}
+
+	accessToken, err := app.createOAuthToken(database.OAuthAccessToken, client, token.UserID, scopes, token.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	refreshToken, err := app.createOAuthToken(database.OAuthRefreshToken, client, token.UserID, token.Scopes, token.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeOAuthTokenResponse(w, r, accessToken, refreshToken)
+}
+
+// createOAuthToken issues an access token, valid for an hour, or a refresh
+// token, valid for 30 days.
+func (app *application) createOAuthToken(kind database.OAuthTokenKind, client *database.OAuthClient, userID uuid.UUID, scopes database.Permissions, family uuid.UUID) (*database.OAuthToken, error) {
+	ttl := time.Hour
+	if kind == database.OAuthRefreshToken {
+		ttl = 30 * 24 * time.Hour
+	}
+
+	token, err := database.GenerateOAuthToken(kind, client.ID, userID, scopes, family, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.OAuth.InsertToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (app *application) writeOAuthTokenResponse(w http.ResponseWriter, r *http.Request, accessToken *database.OAuthToken, refreshToken *database.OAuthToken) {
+	env := envelope{
+		"access_token": accessToken.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(time.Until(accessToken.Expiry).Seconds()),
+		"scope":        strings.Join(accessToken.Scopes, " "),
+	}
+	if refreshToken != nil {
+		env["refresh_token"] = refreshToken.Plaintext
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+
+	err := app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// introspectOAuthTokenHandler implements RFC 7662. Clients can only
+// introspect tokens that were issued to them; any other token is reported
+// as inactive.
+func (app *application) introspectOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	client := app.readOAuthRequest(w, r)
+	if client == nil {
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+
+	token, err := app.models.OAuth.GetToken(client.ID, r.PostForm.Get("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusOK, envelope{"active": false}, headers)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"active":    true,
+		"scope":     strings.Join(token.Scopes, " "),
+		"client_id": token.ClientID,
+		"sub":       token.UserID,
+		"exp":       token.Expiry.Unix(),
+		"iat":       token.CreatedAt.Unix(),
+	}
+	if token.Kind == database.OAuthAccessToken {
+		env["token_type"] = "Bearer"
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeOAuthTokenHandler implements RFC 7009. Revoking either token of a
+// grant revokes the other as well.
+func (app *application) revokeOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	client := app.readOAuthRequest(w, r)
+	if client == nil {
+		return
+	}
+
+	err := app.models.OAuth.RevokeToken(client.ID, r.PostForm.Get("token"))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "token successfully revoked"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lieberdev/go-rest-template/internal/database"
+	"github.com/lieberdev/go-rest-template/internal/oidc"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+func (app *application) createOIDCAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.oidc[chi.URLParam(r, "provider")]
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	state := &database.OIDCState{
+		Provider: provider.Name(),
+		Expiry:   time.Now().Add(10 * time.Minute),
+	}
+
+	var err error
+	for _, value := range []*string{&state.Plaintext, &state.Nonce, &state.CodeVerifier} {
+		*value, err = oidc.GenerateVerifier()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	authorizationURL, err := provider.AuthCodeURL(ctx, state.Plaintext, state.Nonce, state.CodeVerifier)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Identities.InsertState(state)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authorization_url": authorizationURL}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) finishOIDCAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.oidc[chi.URLParam(r, "provider")]
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Code        string `json:"code"`
+		State       string `json:"state"`
+		DeviceLabel string `json:"device_label"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Code != "", "code", "must be provided")
+	v.Check(input.State != "", "state", "must be provided")
+	database.ValidateDeviceLabel(v, input.DeviceLabel)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	state, err := app.models.Identities.ConsumeState(provider.Name(), input.State)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	claims, err := provider.Exchange(ctx, input.Code, state.CodeVerifier, state.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrInvalidIDToken):
+			app.invalidCredentialsResponse(w, r)
+		case errors.Is(err, oidc.ErrUnverifiedEmail):
+			v.AddError("email", "the identity provider did not supply a verified email address")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.userForIdentity(provider.Name(), claims)
+	if err != nil {
+		var verr *validationError
+		switch {
+		case errors.As(err, &verr):
+			app.failedValidationResponse(w, r, verr.errors)
+		case errors.Is(err, database.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Disabled() {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	app.completeLogin(w, r, user, input.DeviceLabel)
+}
+
+// validationError carries validator errors out of helpers that don't write
+// responses themselves.
+type validationError struct {
+	errors map[string]string
+}
+
+func (e *validationError) Error() string {
+	return "validation failed"
+}
+
+// userForIdentity returns the user linked to the external identity. Unknown
+// identities are linked to the user with the same verified email address,
+// which is created if there is none.
+func (app *application) userForIdentity(provider string, claims *oidc.Claims) (*database.User, error) {
+	identity, err := app.models.Identities.Get(provider, claims.Subject)
+	switch {
+	case err == nil:
+		return app.models.Users.Get(identity.UserID)
+	case !errors.Is(err, database.ErrRecordNotFound):
+		return nil, err
+	}
+
+	user, err := app.models.Users.GetByEmail(claims.Email)
+	switch {
+	case errors.Is(err, database.ErrRecordNotFound):
+		user, err = app.createUserForIdentity(claims)
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case user.Disabled():
+		// Disabled users are refused by the caller. They aren't linked or
+		// activated, since only an admin may let them back in.
+		return user, nil
+	case !user.Activated:
+		// The provider verified the email address, which is all
+		// activation asks for. Whoever registered the account may not own
+		// the address though, so as with magic links their password is
+		// replaced and their sessions are signed out.
+		user.Activated = true
+
+		password, err := oidc.GenerateVerifier()
+		if err != nil {
+			return nil, err
+		}
+
+		err = user.Password.Set(password)
+		if err != nil {
+			return nil, err
+		}
+
+		err = app.models.Users.Update(user)
+		if err != nil {
+			return nil, err
+		}
+
+		err = app.revokeAllAccess(user.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	identity = &database.Identity{
+		UserID:   user.ID,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+
+	err = app.models.Identities.Insert(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (app *application) createUserForIdentity(claims *oidc.Claims) (*database.User, error) {
+	firstName, lastName := claims.GivenName, claims.FamilyName
+	if firstName == "" && lastName == "" {
+		firstName, lastName, _ = strings.Cut(claims.Name, " ")
+	}
+
+	user := &database.User{
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     claims.Email,
+		Activated: true,
+	}
+
+	// Users created through a provider sign in through it; the random
+	// password only exists to satisfy the schema and can be replaced
+	// through a password reset.
+	password, err := oidc.GenerateVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+
+	v := validator.New()
+	if database.ValidateUser(v, user); !v.Valid() {
+		return nil, &validationError{errors: v.Errors}
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Roles.InsertForUser(user.ID, app.config.roles.defaults...)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
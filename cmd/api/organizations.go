@@ -0,0 +1,670 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/database"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+// requireOrganizationRole lets the request through if the user has at least
+// the role in the organization it acts in: the one in the orgID URL
+// parameter or, for routes without one, the active organization of the
+// session. Holders of the global admin permission act as owners of every
+// organization. Users who aren't members get a 404 response, as if the
+// organization didn't exist.
+func (app *application) requireOrganizationRole(role database.OrganizationRole, next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		organizationID, ok := app.readOrganizationID(r)
+		if !ok {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		access, err := app.organizationAccess(r, user, organizationID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		switch {
+		case access == nil:
+			app.notFoundResponse(w, r)
+			return
+		case !access.Role.Includes(role):
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		r = app.contextSetOrganization(r, access)
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireActivatedUser(fn)
+}
+
+func (app *application) readOrganizationID(r *http.Request) (uuid.UUID, bool) {
+	if chi.URLParam(r, "orgID") != "" {
+		id, err := app.readUUIDParam(r, "orgID")
+		return id, err == nil
+	}
+
+	token := app.contextGetToken(r)
+	if token == nil || token.OrganizationID == nil {
+		return uuid.Nil, false
+	}
+
+	return *token.OrganizationID, true
+}
+
+// organizationAccess returns the user's access to the organization, or nil
+// if they have none. Admins have owner access to every organization,
+// including those they are an ordinary member of.
+func (app *application) organizationAccess(r *http.Request, user *database.User, organizationID uuid.UUID) (*organizationAccess, error) {
+	permissions, err := app.permissionCheck(r, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if permissions(database.PermissionAdmin) {
+		_, err = app.models.Organizations.Get(organizationID)
+		if err != nil {
+			switch {
+			case errors.Is(err, database.ErrRecordNotFound):
+				return nil, nil
+			default:
+				return nil, err
+			}
+		}
+
+		return &organizationAccess{OrganizationID: organizationID, Role: database.OrganizationRoleOwner}, nil
+	}
+
+	membership, err := app.models.Organizations.GetMembership(organizationID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &organizationAccess{OrganizationID: organizationID, Role: membership.Role}, nil
+}
+
+func (app *application) createOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	organization := &database.Organization{
+		Name: input.Name,
+		Slug: input.Slug,
+	}
+
+	v := validator.New()
+	if database.ValidateOrganization(v, organization); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Organizations.Insert(organization, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrDuplicateSlug):
+			v.AddError("slug", "an organization with this slug already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"organization": organization}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	organizations, err := app.models.Organizations.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"organizations": organizations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	access := app.contextGetOrganization(r)
+
+	organization, err := app.models.Organizations.Get(access.OrganizationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	organization.Role = access.Role
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"organization": organization}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	access := app.contextGetOrganization(r)
+
+	organization, err := app.models.Organizations.Get(access.OrganizationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Name *string `json:"name"`
+		Slug *string `json:"slug"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		organization.Name = *input.Name
+	}
+	if input.Slug != nil {
+		organization.Slug = *input.Slug
+	}
+
+	v := validator.New()
+	if database.ValidateOrganization(v, organization); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Organizations.Update(organization)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrDuplicateSlug):
+			v.AddError("slug", "an organization with this slug already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	organization.Role = access.Role
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"organization": organization}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	access := app.contextGetOrganization(r)
+
+	err := app.models.Organizations.Delete(access.OrganizationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"message": "organization successfully deleted"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOrganizationMembersHandler(w http.ResponseWriter, r *http.Request) {
+	access := app.contextGetOrganization(r)
+
+	members, err := app.models.Organizations.GetMembers(access.OrganizationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"members": members}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateOrganizationMemberHandler changes a member's role. Only owners can
+// make someone an owner or change the role of another owner, and the last
+// owner can't be demoted.
+func (app *application) updateOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	access := app.contextGetOrganization(r)
+
+	member, ok := app.readOrganizationMemberParam(w, r, access)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Role database.OrganizationRole `json:"role"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if database.ValidateOrganizationRole(v, input.Role); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if (input.Role == database.OrganizationRoleOwner || member.Role == database.OrganizationRoleOwner) &&
+		access.Role != database.OrganizationRoleOwner {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	if member.Role == database.OrganizationRoleOwner && input.Role != database.OrganizationRoleOwner {
+		if !app.checkNotLastOwner(w, r, access.OrganizationID) {
+			return
+		}
+	}
+
+	err = app.models.Organizations.UpdateMember(access.OrganizationID, member.UserID, input.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	member.Role = input.Role
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"member": member}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteOrganizationMemberHandler removes a member from the organization.
+// Members can remove themselves; removing others takes an admin, and
+// removing an owner takes an owner. The last owner can't leave.
+func (app *application) deleteOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	access := app.contextGetOrganization(r)
+	user := app.contextGetUser(r)
+
+	member, ok := app.readOrganizationMemberParam(w, r, access)
+	if !ok {
+		return
+	}
+
+	switch {
+	case member.UserID == user.ID:
+	case member.Role == database.OrganizationRoleOwner && access.Role != database.OrganizationRoleOwner,
+		!access.Role.Includes(database.OrganizationRoleAdmin):
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	if member.Role == database.OrganizationRoleOwner {
+		if !app.checkNotLastOwner(w, r, access.OrganizationID) {
+			return
+		}
+	}
+
+	err := app.models.Organizations.DeleteMember(access.OrganizationID, member.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"message": "member successfully removed"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readOrganizationMemberParam looks up the membership of the user in the
+// userID URL parameter. It writes the error response itself and returns
+// false if that fails.
+func (app *application) readOrganizationMemberParam(w http.ResponseWriter, r *http.Request, access *organizationAccess) (*database.Membership, bool) {
+	userID, err := app.readUUIDParam(r, "userID")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	member, err := app.models.Organizations.GetMembership(access.OrganizationID, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return member, true
+}
+
+// checkNotLastOwner responds with a validation error and returns false if
+// the organization has only one owner left.
+func (app *application) checkNotLastOwner(w http.ResponseWriter, r *http.Request, organizationID uuid.UUID) bool {
+	owners, err := app.models.Organizations.CountOwners(organizationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if owners <= 1 {
+		v := validator.New()
+		v.AddError("role", "the organization must keep at least one owner")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	return true
+}
+
+func (app *application) createOrganizationInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	access := app.contextGetOrganization(r)
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Email string                    `json:"email"`
+		Role  database.OrganizationRole `json:"role"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Role == "" {
+		input.Role = database.OrganizationRoleMember
+	}
+
+	v := validator.New()
+	database.ValidateEmail(v, input.Email)
+	database.ValidateOrganizationRole(v, input.Role)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !access.Role.Includes(input.Role) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	organization, err := app.models.Organizations.Get(access.OrganizationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	invitation, err := database.GenerateOrganizationInvitation(organization.ID, input.Email, input.Role, user.ID, 7*24*time.Hour)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Organizations.InsertInvitation(invitation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]any{
+			"organizationName": organization.Name,
+			"role":             invitation.Role,
+			"invitationToken":  invitation.Plaintext,
+		}
+
+		err := app.mailer.Send(invitation.Email, "organization_invitation.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"invitation": invitation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOrganizationInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	access := app.contextGetOrganization(r)
+
+	invitations, err := app.models.Organizations.GetInvitations(access.OrganizationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"invitations": invitations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteOrganizationInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	access := app.contextGetOrganization(r)
+
+	id, err := app.readUUIDParam(r, "invitationID")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Organizations.DeleteInvitation(access.OrganizationID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"message": "invitation successfully deleted"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// acceptOrganizationInvitationHandler makes the user a member of the
+// organization they were invited to. Invitations can only be accepted from
+// the account with the invited email address.
+func (app *application) acceptOrganizationInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if database.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	invitation, err := app.models.Organizations.GetInvitation(input.TokenPlaintext)
+	switch {
+	case errors.Is(err, database.ErrRecordNotFound), err == nil && !strings.EqualFold(invitation.Email, user.Email):
+		v.AddError("token", "invalid or expired invitation token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Organizations.AcceptInvitation(invitation, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired invitation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, database.ErrDuplicateMembership):
+			v.AddError("token", "you are already a member of this organization")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	organization, err := app.models.Organizations.Get(invitation.OrganizationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	organization.Role = invitation.Role
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"organization": organization}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// switchOrganizationHandler changes the active organization of the current
+// session, or clears it if organization_id is null. As the organization is
+// part of the tokens, the session is replaced by one with a new token pair
+// in a new family, and the old family is revoked so that its tokens,
+// stateless ones included, stop working.
+func (app *application) switchOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		OrganizationID *uuid.UUID `json:"organization_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	token := app.contextGetToken(r)
+
+	if input.OrganizationID != nil {
+		access, err := app.organizationAccess(r, user, *input.OrganizationID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if access == nil {
+			v := validator.New()
+			v.AddError("organization_id", "must be an organization you are a member of")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	session := &database.Token{
+		UserID:         user.ID,
+		OrganizationID: input.OrganizationID,
+	}
+
+	i := slices.IndexFunc(sessions, func(s *database.Session) bool { return s.ID == token.Family })
+	if i >= 0 {
+		session.DeviceLabel = sessions[i].DeviceLabel
+	}
+
+	err = app.auth.Revoke(user.ID, token.Family)
+	if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	authToken, refreshToken, err := app.issueTokenPair(r, session)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	_, cookieErr := r.Cookie(sessionCookieName)
+	fromCookie := cookieErr == nil && app.config.cookies.enabled && r.Header.Get("Authorization") == ""
+
+	app.writeTokenPair(w, r, authToken, refreshToken, fromCookie || app.wantsCookies(r))
+}
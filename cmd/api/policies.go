@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/lieberdev/go-rest-template/internal/database"
+	"github.com/lieberdev/go-rest-template/internal/policy"
+)
+
+// defaultPolicies are always in effect. Policies loaded with -policy-file
+// are added to them. Holding "admin" satisfies every permission condition.
+func defaultPolicies() []policy.Policy {
+	return []policy.Policy{
+		{
+			Name:      "users-read-own",
+			Effect:    policy.Allow,
+			Resources: []string{"user"},
+			Actions:   []string{"read"},
+			When:      policy.Owner(),
+		},
+		{
+			Name:      "users-read",
+			Effect:    policy.Allow,
+			Resources: []string{"user"},
+			Actions:   []string{"read"},
+			When:      policy.Permission("users:read"),
+		},
+	}
+}
+
+// authorize evaluates the policies for the action on the resource. It
+// writes the error response itself and returns false if the request isn't
+// allowed.
+func (app *application) authorize(w http.ResponseWriter, r *http.Request, action string, resource policy.Resource) bool {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.permissionCheck(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	// Policies can match resources of the session's active organization
+	// through the subject's organization_id and organization_role.
+	attributes := map[string]any{}
+	if token := app.contextGetToken(r); token != nil && token.OrganizationID != nil {
+		access, err := app.organizationAccess(r, user, *token.OrganizationID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+
+		if access != nil {
+			attributes["organization_id"] = access.OrganizationID.String()
+			attributes["organization_role"] = string(access.Role)
+		}
+	}
+
+	decision := app.policies.Evaluate(policy.Request{
+		Subject: policy.Subject{
+			ID:            user.ID,
+			HasPermission: permissions,
+			Attributes:    attributes,
+		},
+		Action:   action,
+		Resource: resource,
+	})
+
+	if !decision.Allowed {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// requireAuthorization only lets the request through if the policies allow
+// the action on the resource that resolve finds for the request.
+func (app *application) requireAuthorization(action string, resolve func(r *http.Request) (policy.Resource, error), next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resource, err := resolve(r)
+		if err != nil {
+			switch {
+			case errors.Is(err, database.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !app.authorize(w, r, action, resource) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireActivatedUser(fn)
+}
+
+// userResource resolves the user identified by the id URL parameter. A user
+// is their own owner.
+func (app *application) userResource(r *http.Request) (policy.Resource, error) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return policy.Resource{}, database.ErrRecordNotFound
+	}
+
+	return policy.Resource{Type: "user", ID: id.String(), OwnerID: id}, nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 	"github.com/go-chi/httprate"
+	"github.com/lieberdev/go-rest-template/internal/database"
 )
 
 func (app *application) routes() http.Handler {
@@ -18,10 +19,10 @@ func (app *application) routes() http.Handler {
 	router.Use(app.Logger)
 	router.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   app.config.cors.allowedOrigins,
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-Session-Mode"},
 		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: false,
+		AllowCredentials: app.config.cookies.enabled,
 		MaxAge:           300,
 	}))
 	router.Use(httprate.Limit(
@@ -30,6 +31,7 @@ func (app *application) routes() http.Handler {
 		httprate.WithLimitHandler(app.tooManyRequestsResponse),
 	))
 	router.Use(app.authenticate)
+	router.Use(app.logImpersonation)
 
 	router.NotFound(app.notFoundResponse)
 	router.MethodNotAllowed(app.methodNotAllowedResponse)
@@ -37,6 +39,101 @@ func (app *application) routes() http.Handler {
 	router.Get("/healthcheck", app.healthcheckHandler)
 	router.Get("/debug/vars", app.statsHandler)
 
+	router.Post("/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.Delete("/tokens/authentication", app.requireSession(app.deleteAuthenticationTokenHandler))
+	router.Delete("/tokens/authentication/everywhere", app.requireSession(app.forbidImpersonation(app.deleteAllAuthenticationTokensHandler)))
+	router.Put("/tokens/organization", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.switchOrganizationHandler))))
+
+	router.Get("/users/me", app.requireActivatedUser(app.showCurrentUserHandler))
+	router.Patch("/users/me", app.requireActivatedUser(app.updateCurrentUserHandler))
+	router.Delete("/users/me", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.deleteCurrentUserHandler))))
+	router.Post("/users/me/deletion/cancel", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.cancelCurrentUserDeletionHandler))))
+	router.Get("/users/me/export", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.exportCurrentUserHandler))))
+	router.Put("/users/me/password", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.changeCurrentUserPasswordHandler))))
+	router.Post("/users/me/email", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.createEmailChangeHandler))))
+
+	router.Get("/users/me/logins", app.requireActivatedUser(app.requireSession(app.listLoginsHandler)))
+
+	router.Get("/users/me/sessions", app.requireSession(app.listSessionsHandler))
+	router.Delete("/users/me/sessions/{id}", app.requireSession(app.forbidImpersonation(app.deleteSessionHandler)))
+
+	router.Get("/users/me/api-keys", app.requireActivatedUser(app.requireSession(app.listAPIKeysHandler)))
+	router.Post("/users/me/api-keys", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.createAPIKeyHandler))))
+	router.Delete("/users/me/api-keys/{id}", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.deleteAPIKeyHandler))))
+
+	router.Post("/users/me/mfa/totp", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.createTOTPEnrollmentHandler))))
+	router.Put("/users/me/mfa/totp", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.confirmTOTPEnrollmentHandler))))
+	router.Delete("/users/me/mfa/totp", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.deleteTOTPHandler))))
+
+	// Passkey ceremonies can't succeed without an allowed origin, so they
+	// are only offered once -webauthn-origins is set. Existing passkeys can
+	// be listed and deleted either way.
+	if len(app.config.webauthn.Origins) > 0 {
+		router.Post("/users/me/webauthn/registration", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.createWebAuthnRegistrationHandler))))
+		router.Put("/users/me/webauthn/registration", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.finishWebAuthnRegistrationHandler))))
+	}
+	router.Get("/users/me/webauthn/credentials", app.requireActivatedUser(app.requireSession(app.listWebAuthnCredentialsHandler)))
+	router.Delete("/users/me/webauthn/credentials/{id}", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.deleteWebAuthnCredentialHandler))))
+
+	router.Get("/users/me/oauth/clients", app.requireActivatedUser(app.requireSession(app.listOAuthClientsHandler)))
+	router.Post("/users/me/oauth/clients", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.createOAuthClientHandler))))
+	router.Delete("/users/me/oauth/clients/{id}", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.deleteOAuthClientHandler))))
+
+	router.Get("/users/{id}", app.requireAuthorization("read", app.userResource, app.showUserHandler))
+
+	router.Get("/organizations", app.requireActivatedUser(app.listOrganizationsHandler))
+	router.Post("/organizations", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.createOrganizationHandler))))
+	router.Put("/organizations/invitations", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.acceptOrganizationInvitationHandler))))
+	router.Get("/organizations/{orgID}", app.requireOrganizationRole(database.OrganizationRoleMember, app.showOrganizationHandler))
+	router.Patch("/organizations/{orgID}", app.requireOrganizationRole(database.OrganizationRoleAdmin, app.requireSession(app.updateOrganizationHandler)))
+	router.Delete("/organizations/{orgID}", app.requireOrganizationRole(database.OrganizationRoleOwner, app.requireSession(app.deleteOrganizationHandler)))
+	router.Get("/organizations/{orgID}/members", app.requireOrganizationRole(database.OrganizationRoleMember, app.listOrganizationMembersHandler))
+	router.Patch("/organizations/{orgID}/members/{userID}", app.requireOrganizationRole(database.OrganizationRoleAdmin, app.requireSession(app.updateOrganizationMemberHandler)))
+	router.Delete("/organizations/{orgID}/members/{userID}", app.requireOrganizationRole(database.OrganizationRoleMember, app.requireSession(app.deleteOrganizationMemberHandler)))
+	router.Get("/organizations/{orgID}/invitations", app.requireOrganizationRole(database.OrganizationRoleAdmin, app.listOrganizationInvitationsHandler))
+	router.Post("/organizations/{orgID}/invitations", app.requireOrganizationRole(database.OrganizationRoleAdmin, app.requireSession(app.createOrganizationInvitationHandler)))
+	router.Delete("/organizations/{orgID}/invitations/{invitationID}", app.requireOrganizationRole(database.OrganizationRoleAdmin, app.requireSession(app.deleteOrganizationInvitationHandler)))
+
+	router.Get("/oauth/authorize", app.requireActivatedUser(app.requireSession(app.showOAuthAuthorizationHandler)))
+	router.Post("/oauth/authorize", app.requireActivatedUser(app.requireSession(app.forbidImpersonation(app.createOAuthAuthorizationHandler))))
+	router.Post("/oauth/token", app.createOAuthTokenHandler)
+	router.Post("/oauth/introspect", app.introspectOAuthTokenHandler)
+	router.Post("/oauth/revoke", app.revokeOAuthTokenHandler)
+
+	router.Get("/admin/users", app.requirePermission("admin", app.forbidImpersonation(app.listUsersHandler)))
+	router.Get("/admin/users/{id}", app.requirePermission("admin", app.forbidImpersonation(app.showUserHandler)))
+	router.Patch("/admin/users/{id}", app.requirePermission("admin", app.forbidImpersonation(app.updateUserHandler)))
+	router.Delete("/admin/users/{id}", app.requirePermission("admin", app.forbidImpersonation(app.deleteUserHandler)))
+	router.Post("/admin/users/{id}/activate", app.requirePermission("admin", app.forbidImpersonation(app.activateUserByAdminHandler)))
+	router.Post("/admin/users/{id}/deactivate", app.requirePermission("admin", app.forbidImpersonation(app.deactivateUserHandler)))
+	router.Post("/admin/users/{id}/password-reset", app.requirePermission("admin", app.forbidImpersonation(app.resetUserPasswordHandler)))
+	router.Get("/admin/users/{id}/permissions", app.requirePermission("admin", app.forbidImpersonation(app.showUserPermissionsHandler)))
+	router.Post("/admin/users/{id}/permissions", app.requirePermission("admin", app.forbidImpersonation(app.grantUserPermissionsHandler)))
+	router.Delete("/admin/users/{id}/permissions/{code}", app.requirePermission("admin", app.forbidImpersonation(app.revokeUserPermissionHandler)))
+	router.Post("/admin/users/{id}/roles", app.requirePermission("admin", app.forbidImpersonation(app.assignUserRolesHandler)))
+	router.Delete("/admin/users/{id}/roles/{name}", app.requirePermission("admin", app.forbidImpersonation(app.removeUserRoleHandler)))
+	router.Post("/admin/users/{id}/impersonate", app.requirePermission("admin", app.requireSession(app.forbidImpersonation(app.impersonateUserHandler))))
+
+	router.Get("/admin/permissions", app.requirePermission("admin", app.forbidImpersonation(app.listPermissionsHandler)))
+	router.Post("/admin/permissions", app.requirePermission("admin", app.forbidImpersonation(app.createPermissionHandler)))
+	router.Patch("/admin/permissions/{id}", app.requirePermission("admin", app.forbidImpersonation(app.updatePermissionHandler)))
+	router.Delete("/admin/permissions/{id}", app.requirePermission("admin", app.forbidImpersonation(app.deletePermissionHandler)))
+
+	router.Get("/admin/roles", app.requirePermission("admin", app.forbidImpersonation(app.listRolesHandler)))
+	router.Post("/admin/roles", app.requirePermission("admin", app.forbidImpersonation(app.createRoleHandler)))
+	router.Get("/admin/roles/{id}", app.requirePermission("admin", app.forbidImpersonation(app.showRoleHandler)))
+	router.Patch("/admin/roles/{id}", app.requirePermission("admin", app.forbidImpersonation(app.updateRoleHandler)))
+	router.Delete("/admin/roles/{id}", app.requirePermission("admin", app.forbidImpersonation(app.deleteRoleHandler)))
+
+	router.Get("/admin/invitations", app.requirePermission("admin", app.forbidImpersonation(app.listInvitationsHandler)))
+	router.Post("/admin/invitations", app.requirePermission("admin", app.forbidImpersonation(app.createInvitationHandler)))
+	router.Delete("/admin/invitations/{id}", app.requirePermission("admin", app.forbidImpersonation(app.deleteInvitationHandler)))
+
+	router.Get("/admin/audit", app.requirePermission("admin", app.forbidImpersonation(app.listAuditEventsHandler)))
+
+	router.Get("/admin/lockouts", app.requirePermission("admin", app.forbidImpersonation(app.listLockoutsHandler)))
+	router.Delete("/admin/lockouts/{key}", app.requirePermission("admin", app.forbidImpersonation(app.deleteLockoutHandler)))
+
 	router.Group(func(router chi.Router) {
 		router.Use(httprate.Limit(
 			3,
@@ -45,10 +142,24 @@ func (app *application) routes() http.Handler {
 		))
 
 		router.Post("/users/register", app.registerUserHandler)
+		router.Post("/users/register/invitation", app.registerInvitedUserHandler)
 		router.Put("/users/activate", app.activateUserHandler)
 		router.Put("/users/password-reset", app.updateUserPasswordHandler)
+		router.Put("/users/unlock", app.unlockUserHandler)
+		router.Put("/users/logins/not-me", app.reportLoginHandler)
+		router.Put("/users/email", app.confirmEmailChangeHandler)
+		router.Put("/users/email/cancel", app.cancelEmailChangeHandler)
 
 		router.Post("/tokens/authentication", app.createAuthenticationTokenHandler)
+		router.Post("/tokens/mfa", app.createMFAAuthenticationTokenHandler)
+		if len(app.config.webauthn.Origins) > 0 {
+			router.Post("/tokens/webauthn", app.createWebAuthnLoginHandler)
+			router.Put("/tokens/webauthn", app.finishWebAuthnLoginHandler)
+		}
+		router.Post("/tokens/magic-link", app.createMagicLinkTokenHandler)
+		router.Put("/tokens/magic-link", app.redeemMagicLinkTokenHandler)
+		router.Post("/tokens/oidc/{provider}", app.createOIDCAuthorizationHandler)
+		router.Put("/tokens/oidc/{provider}", app.finishOIDCAuthorizationHandler)
 		router.Post("/tokens/password-reset", app.createPasswordResetTokenHandler)
 		router.Post("/tokens/activation", app.createActivationTokenHandler)
 	})
@@ -46,7 +46,9 @@ func (app *application) serve() error {
 			slog.String("addr", srv.Addr),
 		)
 
+		close(app.shutdown)
 		app.waitgroup.Wait()
+		app.flushSessionActivity()
 		shutdownError <- nil
 	}()
 
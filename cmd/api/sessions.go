@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/database"
+)
+
+type sessionActivity struct {
+	lastUsedAt time.Time
+	userAgent  string
+	ipAddress  string
+}
+
+// sessionTracker collects the last-used data of authenticated requests in
+// memory so the authenticate middleware doesn't have to write to the database
+// on every request. The collected data is written out periodically.
+type sessionTracker struct {
+	mu      sync.Mutex
+	pending map[uuid.UUID]sessionActivity
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{pending: make(map[uuid.UUID]sessionActivity)}
+}
+
+func (t *sessionTracker) touch(family uuid.UUID, userAgent string, ipAddress string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending[family] = sessionActivity{
+		lastUsedAt: time.Now(),
+		userAgent:  userAgent,
+		ipAddress:  ipAddress,
+	}
+}
+
+func (t *sessionTracker) drain() map[uuid.UUID]sessionActivity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending := t.pending
+	t.pending = make(map[uuid.UUID]sessionActivity)
+	return pending
+}
+
+func (app *application) flushSessionActivity() {
+	for family, activity := range app.sessions.drain() {
+		err := app.models.Tokens.UpdateLastUsed(family, activity.lastUsedAt, activity.userAgent, activity.ipAddress)
+		if err != nil {
+			app.logger.Error(err.Error(), slog.String("family", family.String()))
+		}
+	}
+}
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	token := app.contextGetToken(r)
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, session := range sessions {
+		session.Current = token != nil && session.ID == token.Family
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.auth.Revoke(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"message": "session successfully revoked"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeAllAccess signs the user out everywhere, revokes the grants of the
+// OAuth clients they authorized and deletes their API keys, for when
+// someone else may have gained access to the account.
+func (app *application) revokeAllAccess(userID uuid.UUID) error {
+	err := app.auth.RevokeAll(userID)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.OAuth.DeleteAllForUser(userID)
+	if err != nil {
+		return err
+	}
+
+	return app.models.APIKeys.DeleteAllForUser(userID)
+}
+
+// revokeOtherSessions signs the user out everywhere except in the session
+// with the given family.
+func (app *application) revokeOtherSessions(userID uuid.UUID, current uuid.UUID) error {
+	sessions, err := app.models.Tokens.GetSessionsForUser(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.ID == current {
+			continue
+		}
+
+		err = app.auth.Revoke(userID, session.ID)
+		if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
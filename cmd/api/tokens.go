@@ -1,18 +1,22 @@
 package main
 
 import (
+	"crypto/rand"
 	"errors"
+	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/lieberdev/go-rest-template/internal/database"
 	"github.com/lieberdev/go-rest-template/internal/validator"
 )
 
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email       string `json:"email"`
+		Password    string `json:"password"`
+		DeviceLabel string `json:"device_label"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -24,15 +28,36 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	v := validator.New()
 	database.ValidateEmail(v, input.Email)
 	database.ValidatePasswordPlaintext(v, input.Password)
+	database.ValidateDeviceLabel(v, input.DeviceLabel)
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	lockedUntil, err := app.models.Throttles.LockedUntil(database.IPThrottleKey(app.clientIP(r)))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !lockedUntil.IsZero() {
+		app.loginLockedResponse(w, r, lockedUntil)
+		return
+	}
+
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, database.ErrRecordNotFound):
+			err = app.recordLoginFailure(r, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.audit(r, database.AuditEvent{
+				Type:     database.AuditLoginFailed,
+				Metadata: map[string]any{"email": input.Email, "reason": "unknown email"},
+			})
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -40,6 +65,17 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	lockedUntil, err = app.models.Throttles.LockedUntil(database.UserThrottleKey(user.ID))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !lockedUntil.IsZero() {
+		app.loginLockedResponse(w, r, lockedUntil)
+		return
+	}
+
 	match, err := user.Password.Matches(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -47,29 +83,232 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	if !match {
+		err = app.recordLoginFailure(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.audit(r, database.AuditEvent{
+			Type:     database.AuditLoginFailed,
+			TargetID: &user.ID,
+			Metadata: map[string]any{"email": input.Email, "reason": "wrong password"},
+		})
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	token, err := database.GenerateToken(user.ID, 24*time.Hour, database.ScopeAuthentication)
+	if user.Disabled() {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	// Users with two-factor authentication keep their failed logins until
+	// the second factor is verified too, so that guessing codes counts
+	// towards the lockout.
+	if !user.MFAEnabled {
+		err = app.models.Throttles.Delete(database.UserThrottleKey(user.ID))
+		if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.completeLogin(w, r, user, input.DeviceLabel)
+}
+
+// completeLogin finishes a login once the user's first factor has been
+// verified. Users with two-factor authentication enabled get a short-lived
+// mfa-pending token to exchange at POST /tokens/mfa, everyone else gets an
+// authentication and refresh token pair.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *database.User, deviceLabel string) {
+	if user.MFAEnabled {
+		token, err := database.GenerateToken(user.ID, 5*time.Minute, database.ScopeMFAPending)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token.DeviceLabel = deviceLabel
+
+		err = app.models.Tokens.Insert(token)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"mfa_pending_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.completeAuthentication(w, r, user, deviceLabel)
+}
+
+// completeAuthentication starts a new session for a fully authenticated
+// user and responds with its authentication and refresh token pair.
+func (app *application) completeAuthentication(w http.ResponseWriter, r *http.Request, user *database.User, deviceLabel string) {
+	family, err := uuid.NewV7()
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.models.Tokens.Insert(token)
+	session := &database.Token{UserID: user.ID, Family: family, DeviceLabel: deviceLabel}
+
+	err = app.recordLogin(r, user, family)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	authToken, refreshToken, err := app.issueTokenPair(r, session)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
 	}
+
+	app.audit(r, database.AuditEvent{
+		Type:     database.AuditLoginSucceeded,
+		ActorID:  &user.ID,
+		TargetID: &user.ID,
+		Metadata: map[string]any{"session": authToken.Family},
+	})
+
+	app.writeTokenPair(w, r, authToken, refreshToken, app.wantsCookies(r))
 }
 
-func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	// Browsers in cookie mode send the refresh token as a cookie and no body.
+	cookie, err := r.Cookie(refreshCookieName)
+	fromCookie := err == nil && app.config.cookies.enabled && r.ContentLength == 0
+
+	if fromCookie {
+		input.TokenPlaintext = cookie.Value
+	} else {
+		err = app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	v := validator.New()
+	if database.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The CSRF token belongs to the refresh token's session. It is checked
+	// before the refresh token is spent, so that a forged request can't
+	// burn it.
+	if fromCookie {
+		token, err := app.models.Tokens.Get(database.ScopeRefresh, input.TokenPlaintext)
+		if err != nil {
+			switch {
+			case errors.Is(err, database.ErrRecordNotFound):
+				app.invalidCredentialsResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !app.validCSRFToken(r, token.Family) {
+			app.invalidCSRFTokenResponse(w, r)
+			return
+		}
+	}
+
+	token, err := app.models.Tokens.Consume(database.ScopeRefresh, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		case errors.Is(err, database.ErrTokenReused):
+			app.logger.Warn("refresh token reused, token family revoked",
+				slog.String("request_url", r.URL.String()),
+				slog.String("family", token.Family.String()),
+			)
+			err = app.auth.Revoke(token.UserID, token.Family)
+			if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user.Disabled() {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	authToken, refreshToken, err := app.issueTokenPair(r, token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeTokenPair(w, r, authToken, refreshToken, fromCookie || app.wantsCookies(r))
+}
+
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	token := app.contextGetToken(r)
+
+	err := app.auth.Revoke(user.ID, token.Family)
+	if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if app.config.cookies.enabled {
+		app.clearSessionCookies(w)
+	}
+
+	env := envelope{"message": "you have been logged out"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.auth.RevokeAll(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if app.config.cookies.enabled {
+		app.clearSessionCookies(w)
+	}
+
+	env := envelope{"message": "you have been logged out on all devices"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email string `json:"email"`
 	}
@@ -98,13 +337,7 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	if !user.Activated {
-		v.AddError("email", "user account must be activated")
-		app.failedValidationResponse(w, r, v.Errors)
-		return
-	}
-
-	token, err := database.GenerateToken(user.ID, 15*time.Minute, database.ScopePasswordReset)
+	token, err := database.GenerateToken(user.ID, 15*time.Minute, database.ScopeMagicLink)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -116,17 +349,196 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
+	app.audit(r, database.AuditEvent{
+		Type:     database.AuditTokenCreated,
+		TargetID: &user.ID,
+		Metadata: map[string]any{"scope": database.ScopeMagicLink},
+	})
+
 	app.background(func() {
 		data := map[string]any{
-			"passwordResetToken": token.Plaintext,
+			"magicLinkToken": token.Plaintext,
 		}
 
-		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		err = app.mailer.Send(user.Email, "token_magic_link.tmpl", data)
 		if err != nil {
 			app.logger.Error(err.Error())
 		}
 	})
 
+	env := envelope{"message": "an email will be sent to you containing a sign-in link"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) redeemMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		DeviceLabel    string `json:"device_label"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	database.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	database.ValidateDeviceLabel(v, input.DeviceLabel)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByToken(database.ScopeMagicLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired sign-in token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Disabled() {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(database.ScopeMagicLink, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Following the link proves the user owns the email address, which is
+	// all activation asks for. It doesn't prove they registered the account:
+	// someone else may have, to take it over once it's activated. So the
+	// password they set is replaced with a random one and their sessions are
+	// signed out; the owner can set a password through a password reset.
+	if !user.Activated {
+		user.Activated = true
+
+		err = user.Password.Set(rand.Text())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.Users.Update(user)
+		if err != nil {
+			switch {
+			case errors.Is(err, database.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.revokeAllAccess(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.audit(r, database.AuditEvent{Type: database.AuditUserActivated, ActorID: &user.ID, TargetID: &user.ID})
+	}
+
+	app.completeLogin(w, r, user, input.DeviceLabel)
+}
+
+// issueTokenPair creates a short-lived authentication token and a single-use
+// refresh token for the session's user. Both tokens carry over the session's
+// family and device label; a session without a family starts a new one.
+func (app *application) issueTokenPair(r *http.Request, session *database.Token) (*database.Token, *database.Token, error) {
+	authToken, err := database.GenerateToken(session.UserID, 15*time.Minute, database.ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken, err := database.GenerateToken(session.UserID, 30*24*time.Hour, database.ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if session.Family != uuid.Nil {
+		authToken.Family = session.Family
+	}
+
+	for _, token := range []*database.Token{authToken, refreshToken} {
+		token.Family = authToken.Family
+		token.DeviceLabel = session.DeviceLabel
+		token.OrganizationID = session.OrganizationID
+		token.UserAgent = r.UserAgent()
+		token.IPAddress = app.clientIP(r)
+	}
+
+	err = app.auth.Issue(authToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = app.models.Tokens.Insert(refreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return authToken, refreshToken, nil
+}
+
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if database.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated {
+		v.AddError("email", "user account must be activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.sendPasswordResetToken(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{
+		Type:     database.AuditTokenCreated,
+		TargetID: &user.ID,
+		Metadata: map[string]any{"scope": database.ScopePasswordReset},
+	})
+
 	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
 	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
@@ -181,6 +593,12 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
+	app.audit(r, database.AuditEvent{
+		Type:     database.AuditTokenCreated,
+		TargetID: &user.ID,
+		Metadata: map[string]any{"scope": database.ScopeActivation},
+	})
+
 	app.background(func() {
 		data := map[string]any{
 			"activationToken": token.Plaintext,
@@ -198,3 +616,29 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// sendPasswordResetToken emails the user a token to set a new password with.
+func (app *application) sendPasswordResetToken(user *database.User) error {
+	token, err := database.GenerateToken(user.ID, 15*time.Minute, database.ScopePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Tokens.Insert(token)
+	if err != nil {
+		return err
+	}
+
+	app.background(func() {
+		data := map[string]any{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"log/slog"
 	"net/http"
 	"time"
 
@@ -53,11 +54,13 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// err = app.models.Permissions.InsertForUser(user.ID, "default")
-	// if err != nil {
-	// 	app.serverErrorResponse(w, r, err)
-	// 	return
-	// }
+	err = app.models.Roles.InsertForUser(user.ID, app.config.roles.defaults...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Type: database.AuditUserRegistered, ActorID: &user.ID, TargetID: &user.ID})
 
 	token, err := database.GenerateToken(user.ID, 30*time.Minute, database.ScopeActivation)
 	if err != nil {
@@ -136,6 +139,8 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	app.audit(r, database.AuditEvent{Type: database.AuditUserActivated, ActorID: &user.ID, TargetID: &user.ID})
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -197,9 +202,379 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	err = app.revokeAllAccess(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Whoever can reset the password doesn't need to wait out a lockout.
+	err = app.models.Throttles.Delete(database.UserThrottleKey(user.ID))
+	if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Type: database.AuditPasswordReset, ActorID: &user.ID, TargetID: &user.ID})
+
 	env := envelope{"message": "your password was successfully reset"}
 	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		FirstName *string `json:"first_name"`
+		LastName  *string `json:"last_name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if input.FirstName != nil {
+		user.FirstName = *input.FirstName
+	}
+	if input.LastName != nil {
+		user.LastName = *input.LastName
+	}
+
+	v := validator.New()
+	if database.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) changeCurrentUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("current_password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if database.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.revokeOtherSessions(user.ID, app.contextGetToken(r).Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.OAuth.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Type: database.AuditPasswordChanged, TargetID: &user.ID})
+
+	env := envelope{"message": "your password was successfully changed and your other sessions were signed out"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCurrentUserHandler schedules the user's account for deletion once
+// the grace period is over. Until then the user can still sign in and cancel
+// the deletion; all other sessions are signed out right away.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Password != "", "password", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deletionScheduledAt := time.Now().Add(app.config.deletion.gracePeriod)
+
+	err = app.models.Users.ScheduleDeletion(user.ID, deletionScheduledAt)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.revokeOtherSessions(user.ID, app.contextGetToken(r).Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{
+		Type:     database.AuditDeletionScheduled,
+		TargetID: &user.ID,
+		Metadata: map[string]any{"deletion_scheduled_at": deletionScheduledAt},
+	})
+
+	app.background(func() {
+		data := map[string]any{
+			"deletionScheduledAt": deletionScheduledAt.UTC().Format(time.RFC1123),
+		}
+
+		err := app.mailer.Send(user.Email, "user_deletion_scheduled.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	env := envelope{
+		"message":               "your account is scheduled for deletion",
+		"deletion_scheduled_at": deletionScheduledAt,
+	}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) cancelCurrentUserDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Users.CancelDeletion(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Type: database.AuditDeletionCancelled, TargetID: &user.ID})
+
+	env := envelope{"message": "the deletion of your account was successfully cancelled"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteScheduledUsers hard deletes the users whose grace period is over.
+func (app *application) deleteScheduledUsers() {
+	deleted, err := app.models.Users.DeleteScheduled()
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+
+	if deleted > 0 {
+		app.logger.Info("deleted users scheduled for deletion", slog.Int64("count", deleted))
+	}
+}
+
+// exportCurrentUserHandler responds with everything stored about the user,
+// as a downloadable JSON document, to answer data subject access requests.
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	credentials, err := app.models.WebAuthn.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	identities, err := app.models.Identities.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	oauthClients, err := app.models.OAuth.GetClientsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	organizations, err := app.models.Organizations.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	logins := []*database.LoginEvent{}
+	filters := database.CursorFilters{PageSize: 100}
+	for {
+		page, metadata, err := app.models.Logins.GetAllForUser(user.ID, filters)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		logins = append(logins, page...)
+
+		if metadata.NextCursor == nil {
+			break
+		}
+		filters.Cursor = metadata.NextCursor
+	}
+
+	auditEvents, err := app.models.Audit.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Events someone else performed on the user, like an admin or whoever
+	// failed to sign in as them, carry that someone's IP address and user
+	// agent, and so do events an admin performed while impersonating the
+	// user. The export leaves those out.
+	for _, event := range auditEvents {
+		if event.ActorID == nil || *event.ActorID != user.ID {
+			event.IPAddress = ""
+			event.UserAgent = ""
+			event.ImpersonatorID = nil
+		}
+		if event.ImpersonatorID != nil {
+			event.IPAddress = ""
+			event.UserAgent = ""
+		}
+	}
+
+	if permissions == nil {
+		permissions = database.Permissions{}
+	}
+
+	export := envelope{
+		"exported_at":          time.Now(),
+		"user":                 user,
+		"permissions":          permissions,
+		"sessions":             sessions,
+		"api_keys":             apiKeys,
+		"webauthn_credentials": credentials,
+		"identities":           identities,
+		"oauth_clients":        oauthClients,
+		"organizations":        organizations,
+		"logins":               logins,
+		"audit_events":         auditEvents,
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Disposition", `attachment; filename="export.json"`)
+	headers.Set("Cache-Control", "no-store")
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"export": export}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
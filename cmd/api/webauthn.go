@@ -0,0 +1,415 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/database"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+	"github.com/lieberdev/go-rest-template/internal/webauthn"
+)
+
+type webauthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+func (app *application) createWebAuthnRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	credentials, err := app.models.WebAuthn.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := database.GenerateToken(user.ID, 5*time.Minute, database.ScopeWebAuthnRegistration)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.Insert(token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The options follow the PublicKeyCredentialCreationOptions dictionary,
+	// with binary values base64url encoded.
+	options := map[string]any{
+		"challenge": webauthn.EncodeBase64([]byte(token.Plaintext)),
+		"rp": map[string]string{
+			"id":   app.config.webauthn.RPID,
+			"name": app.config.webauthn.RPName,
+		},
+		"user": map[string]string{
+			"id":          webauthn.EncodeBase64(user.ID[:]),
+			"name":        user.Email,
+			"displayName": user.FirstName + " " + user.LastName,
+		},
+		"pubKeyCredParams": []map[string]any{
+			{"type": "public-key", "alg": webauthn.AlgES256},
+			{"type": "public-key", "alg": webauthn.AlgEdDSA},
+			{"type": "public-key", "alg": webauthn.AlgRS256},
+		},
+		"excludeCredentials": app.webauthnDescriptors(credentials),
+		"timeout":            (5 * time.Minute).Milliseconds(),
+		"attestation":        "none",
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "required",
+		},
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"public_key": options}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) finishWebAuthnRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name              string `json:"name"`
+		ClientDataJSON    string `json:"client_data_json"`
+		AttestationObject string `json:"attestation_object"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	credential := &database.WebAuthnCredential{
+		UserID: user.ID,
+		Name:   input.Name,
+	}
+
+	v := validator.New()
+	if database.ValidateWebAuthnCredential(v, credential); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	clientDataJSON, err := webauthn.DecodeBase64(input.ClientDataJSON)
+	if err != nil {
+		app.badRequestResponse(w, r, errors.New("client_data_json must be base64url encoded"))
+		return
+	}
+
+	attestationObject, err := webauthn.DecodeBase64(input.AttestationObject)
+	if err != nil {
+		app.badRequestResponse(w, r, errors.New("attestation_object must be base64url encoded"))
+		return
+	}
+
+	challenge, err := app.webauthnChallengeOwner(database.ScopeWebAuthnRegistration, clientDataJSON, user.ID)
+	if err != nil {
+		app.webauthnErrorResponse(w, r, err)
+		return
+	}
+
+	verified, err := app.config.webauthn.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		app.webauthnErrorResponse(w, r, err)
+		return
+	}
+
+	credential.CredentialID = verified.ID
+	credential.PublicKey = verified.PublicKey
+	credential.SignCount = verified.SignCount
+	credential.Session = &app.contextGetToken(r).Family
+
+	err = app.models.WebAuthn.Insert(credential)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrDuplicateCredential):
+			v.AddError("credential", "this credential has already been registered")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(database.ScopeWebAuthnRegistration, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"credential": credential}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebAuthnCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	credentials, err := app.models.WebAuthn.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"credentials": credentials}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebAuthnCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.WebAuthn.DeleteForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"message": "credential successfully removed"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createWebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if database.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	credentials, err := app.models.WebAuthn.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if len(credentials) == 0 {
+		v.AddError("email", "no passkeys have been registered for this account")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := database.GenerateToken(user.ID, 5*time.Minute, database.ScopeWebAuthnLogin)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.Insert(token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The options follow the PublicKeyCredentialRequestOptions dictionary,
+	// with binary values base64url encoded.
+	options := map[string]any{
+		"challenge":        webauthn.EncodeBase64([]byte(token.Plaintext)),
+		"rpId":             app.config.webauthn.RPID,
+		"allowCredentials": app.webauthnDescriptors(credentials),
+		"timeout":          (5 * time.Minute).Milliseconds(),
+		"userVerification": "required",
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"public_key": options}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) finishWebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CredentialID      string `json:"credential_id"`
+		ClientDataJSON    string `json:"client_data_json"`
+		AuthenticatorData string `json:"authenticator_data"`
+		Signature         string `json:"signature"`
+		DeviceLabel       string `json:"device_label"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if database.ValidateDeviceLabel(v, input.DeviceLabel); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var credentialID, clientDataJSON, authenticatorData, signature []byte
+	for _, field := range []struct {
+		name  string
+		value string
+		dst   *[]byte
+	}{
+		{"credential_id", input.CredentialID, &credentialID},
+		{"client_data_json", input.ClientDataJSON, &clientDataJSON},
+		{"authenticator_data", input.AuthenticatorData, &authenticatorData},
+		{"signature", input.Signature, &signature},
+	} {
+		*field.dst, err = webauthn.DecodeBase64(field.value)
+		if err != nil || len(*field.dst) == 0 {
+			app.badRequestResponse(w, r, errors.New(field.name+" must be base64url encoded"))
+			return
+		}
+	}
+
+	challenge, err := webauthn.Challenge(clientDataJSON)
+	if err != nil {
+		app.webauthnErrorResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.GetByToken(database.ScopeWebAuthnLogin, string(challenge))
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Disabled() {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	credential, err := app.models.WebAuthn.GetForUser(credentialID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	signCount, err := app.config.webauthn.VerifyAssertion(
+		challenge,
+		webauthn.Credential{ID: credential.CredentialID, PublicKey: credential.PublicKey, SignCount: credential.SignCount},
+		clientDataJSON,
+		authenticatorData,
+		signature,
+	)
+	if err != nil {
+		app.webauthnErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.WebAuthn.UpdateSignCount(credential.ID, signCount)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrEditConflict):
+			app.webauthnErrorResponse(w, r, webauthn.ErrSignCount)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(database.ScopeWebAuthnLogin, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.completeAuthentication(w, r, user, input.DeviceLabel)
+}
+
+// webauthnChallengeOwner returns the challenge of the client data after
+// checking that it was issued to the user for the given ceremony.
+func (app *application) webauthnChallengeOwner(scope database.Scope, clientDataJSON []byte, userID uuid.UUID) ([]byte, error) {
+	challenge, err := webauthn.Challenge(clientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	owner, err := app.models.Users.GetByToken(scope, string(challenge))
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			return nil, webauthn.ErrInvalidCeremony
+		default:
+			return nil, err
+		}
+	}
+
+	if owner.ID != userID {
+		return nil, webauthn.ErrInvalidCeremony
+	}
+
+	return challenge, nil
+}
+
+func (app *application) webauthnDescriptors(credentials []*database.WebAuthnCredential) []webauthnCredentialDescriptor {
+	descriptors := []webauthnCredentialDescriptor{}
+	for _, credential := range credentials {
+		descriptors = append(descriptors, webauthnCredentialDescriptor{
+			Type: "public-key",
+			ID:   webauthn.EncodeBase64(credential.CredentialID),
+		})
+	}
+	return descriptors
+}
+
+func (app *application) webauthnErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, webauthn.ErrInvalidCeremony), errors.Is(err, webauthn.ErrUnsupportedKey):
+		v := validator.New()
+		v.AddError("credential", "the credential could not be verified")
+		app.failedValidationResponse(w, r, v.Errors)
+	case errors.Is(err, webauthn.ErrSignCount):
+		app.logger.Warn(err.Error())
+		app.invalidCredentialsResponse(w, r)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
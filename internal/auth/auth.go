@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/database"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// Strategy decides what the authentication tokens handed out to clients look
+// like and how they are verified and revoked. Refresh tokens and all other
+// scopes are always opaque tokens stored in the tokens table.
+type Strategy interface {
+	// Issue sets the plaintext of a generated authentication token and
+	// stores the token if the strategy needs it to be stored.
+	Issue(token *database.Token) error
+	// Authenticate returns the user and token for a plaintext
+	// authentication token, or ErrInvalidToken.
+	Authenticate(tokenPlaintext string) (*database.User, *database.Token, error)
+	// Revoke invalidates every token in the user's token family.
+	Revoke(userID uuid.UUID, family uuid.UUID) error
+	// RevokeAll invalidates every authentication and refresh token the
+	// user holds.
+	RevokeAll(userID uuid.UUID) error
+}
+
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+type Config struct {
+	Strategy string
+	// Keys used to sign tokens. The first key signs new tokens, the others
+	// are only used to verify tokens issued before a key rotation.
+	Keys     []Key
+	Denylist bool
+}
+
+func New(cfg Config, models database.Models) (Strategy, error) {
+	switch cfg.Strategy {
+	case "opaque":
+		return &Opaque{models: models}, nil
+	case "paseto":
+		return NewPaseto(cfg.Keys, cfg.Denylist, models)
+	default:
+		return nil, fmt.Errorf("unknown token strategy %q", cfg.Strategy)
+	}
+}
+
+// ParseKey parses a key in the "id:hex-encoded-secret" format.
+func ParseKey(val string) (Key, error) {
+	id, secret, ok := strings.Cut(val, ":")
+	if !ok || id == "" {
+		return Key{}, errors.New("key must be in the id:secret format")
+	}
+
+	key := Key{ID: id}
+
+	var err error
+	key.Secret, err = hex.DecodeString(secret)
+	if err != nil {
+		return Key{}, fmt.Errorf("key %q: secret must be hex encoded", id)
+	}
+
+	if len(key.Secret) != 32 {
+		return Key{}, fmt.Errorf("key %q: secret must be 32 bytes long", id)
+	}
+
+	return key, nil
+}
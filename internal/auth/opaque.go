@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/database"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+// Opaque hands out random tokens of which only the SHA-256 hash is stored in
+// the tokens table. Every authentication looks the token up in the database.
+type Opaque struct {
+	models database.Models
+}
+
+func (s *Opaque) Issue(token *database.Token) error {
+	return s.models.Tokens.Insert(token)
+}
+
+func (s *Opaque) Authenticate(tokenPlaintext string) (*database.User, *database.Token, error) {
+	v := validator.New()
+	if database.ValidateTokenPlaintext(v, tokenPlaintext); !v.Valid() {
+		return nil, nil, ErrInvalidToken
+	}
+
+	user, token, err := s.models.Users.GetByAuthenticationToken(tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			return nil, nil, ErrInvalidToken
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return user, token, nil
+}
+
+func (s *Opaque) Revoke(userID uuid.UUID, family uuid.UUID) error {
+	return s.models.Tokens.DeleteFamilyForUser(userID, family)
+}
+
+func (s *Opaque) RevokeAll(userID uuid.UUID) error {
+	return s.models.Tokens.DeleteAllSessionsForUser(userID)
+}
@@ -0,0 +1,363 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/database"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+)
+
+const pasetoHeader = "v4.local."
+
+// denylistTTL is how long a revoked family stays on the denylist. Paseto
+// refuses to issue tokens that would outlive their denylist entry.
+const denylistTTL = 24 * time.Hour
+
+type pasetoClaims struct {
+	Subject  uuid.UUID      `json:"sub"`
+	Session  uuid.UUID      `json:"sid"`
+	Scope    database.Scope `json:"scope"`
+	IssuedAt time.Time      `json:"iat"`
+	Expiry   time.Time      `json:"exp"`
+	// Organization is the active organization of the session.
+	Organization *uuid.UUID `json:"org,omitempty"`
+	// Impersonator is the admin acting as the subject.
+	Impersonator *uuid.UUID `json:"act,omitempty"`
+}
+
+type pasetoFooter struct {
+	KeyID string `json:"kid"`
+}
+
+// Paseto hands out self-contained PASETO v4.local tokens carrying the user
+// ID, scope, expiry and token family. Verifying them needs no token lookup.
+// Because the tokens aren't stored, revoking them relies on the optional
+// denylist; without it revoked tokens stay valid until they expire.
+type Paseto struct {
+	keys     []Key
+	denylist bool
+	models   database.Models
+}
+
+func NewPaseto(keys []Key, denylist bool, models database.Models) (*Paseto, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("paseto token strategy requires at least one key")
+	}
+
+	return &Paseto{keys: keys, denylist: denylist, models: models}, nil
+}
+
+func (s *Paseto) Issue(token *database.Token) error {
+	if time.Until(token.Expiry) > denylistTTL {
+		return errors.New("paseto tokens must not live longer than the denylist retention")
+	}
+
+	claims := pasetoClaims{
+		Subject:      token.UserID,
+		Session:      token.Family,
+		Scope:        token.Scope,
+		IssuedAt:     time.Now(),
+		Expiry:       token.Expiry,
+		Organization: token.OrganizationID,
+		Impersonator: token.ImpersonatorID,
+	}
+
+	plaintext, err := s.encrypt(s.keys[0], claims)
+	if err != nil {
+		return err
+	}
+
+	// RevokeAll has to know about the family even after its refresh token
+	// is gone, as its access tokens remain valid until they expire.
+	if s.denylist {
+		err = s.models.Denylist.Track(token.UserID, token.Family, token.Expiry)
+		if err != nil {
+			return err
+		}
+	}
+
+	token.Plaintext = plaintext
+	token.Hash = nil
+
+	return nil
+}
+
+func (s *Paseto) Authenticate(tokenPlaintext string) (*database.User, *database.Token, error) {
+	claims, err := s.decrypt(tokenPlaintext)
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	if claims.Scope != database.ScopeAuthentication || time.Now().After(claims.Expiry) {
+		return nil, nil, ErrInvalidToken
+	}
+
+	token := &database.Token{
+		Plaintext:      tokenPlaintext,
+		UserID:         claims.Subject,
+		Expiry:         claims.Expiry,
+		Scope:          claims.Scope,
+		Family:         claims.Session,
+		OrganizationID: claims.Organization,
+		ImpersonatorID: claims.Impersonator,
+	}
+
+	user, token, err := s.models.Users.GetByStatelessToken(token, s.denylist)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRecordNotFound):
+			return nil, nil, ErrInvalidToken
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return user, token, nil
+}
+
+// Revoke deletes the family's refresh token and denylists its stateless
+// tokens. Both are scoped to the user, and ErrRecordNotFound is returned
+// only if the user has neither.
+func (s *Paseto) Revoke(userID uuid.UUID, family uuid.UUID) error {
+	err := s.models.Tokens.DeleteFamilyForUser(userID, family)
+	if err != nil && !errors.Is(err, database.ErrRecordNotFound) {
+		return err
+	}
+
+	if !s.denylist {
+		return err
+	}
+
+	// The refresh token may be gone while the family's authentication
+	// tokens are still valid, so the family is denylisted either way.
+	denylistErr := s.models.Denylist.Insert(userID, family, time.Now().Add(denylistTTL))
+	switch {
+	case denylistErr == nil:
+		return nil
+	case errors.Is(denylistErr, database.ErrRecordNotFound):
+		return err
+	default:
+		return denylistErr
+	}
+}
+
+func (s *Paseto) RevokeAll(userID uuid.UUID) error {
+	if s.denylist {
+		err := s.models.Denylist.InsertAllForUser(userID, time.Now().Add(denylistTTL))
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.models.Tokens.DeleteAllSessionsForUser(userID)
+}
+
+func (s *Paseto) key(id string) (Key, bool) {
+	for _, key := range s.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// encrypt implements the PASETO v4.local encryption algorithm with the key ID
+// in the footer and an empty implicit assertion.
+func (s *Paseto) encrypt(key Key, claims pasetoClaims) (string, error) {
+	message, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	footer, err := json.Marshal(pasetoFooter{KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, 32)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	return pasetoSeal(key.Secret, nonce, message, footer)
+}
+
+func (s *Paseto) decrypt(tokenPlaintext string) (*pasetoClaims, error) {
+	body, ok := strings.CutPrefix(tokenPlaintext, pasetoHeader)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	_, encodedFooter, ok := strings.Cut(body, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	footer, err := base64.RawURLEncoding.DecodeString(encodedFooter)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var f pasetoFooter
+	err = json.Unmarshal(footer, &f)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, ok := s.key(f.KeyID)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	message, err := pasetoOpen(key.Secret, tokenPlaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims pasetoClaims
+	err = json.Unmarshal(message, &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	return &claims, nil
+}
+
+// pasetoSeal encrypts and authenticates the message into a v4.local token.
+// The nonce must be 32 random bytes; it is only a parameter so that the
+// implementation can be checked against the published test vectors.
+func pasetoSeal(secret []byte, nonce []byte, message []byte, footer []byte) (string, error) {
+	encryptionKey, counterNonce, authKey, err := pasetoSplitKey(secret, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(encryptionKey, counterNonce)
+	if err != nil {
+		return "", err
+	}
+	ciphertext := make([]byte, len(message))
+	cipher.XORKeyStream(ciphertext, message)
+
+	tag, err := pasetoTag(authKey, nonce, ciphertext, footer)
+	if err != nil {
+		return "", err
+	}
+
+	payload := append(append(append([]byte{}, nonce...), ciphertext...), tag...)
+
+	token := pasetoHeader + base64.RawURLEncoding.EncodeToString(payload)
+	if len(footer) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(footer)
+	}
+
+	return token, nil
+}
+
+// pasetoOpen verifies a v4.local token and returns its decrypted message.
+func pasetoOpen(secret []byte, tokenPlaintext string) ([]byte, error) {
+	body, ok := strings.CutPrefix(tokenPlaintext, pasetoHeader)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	encodedPayload, encodedFooter, _ := strings.Cut(body, ".")
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil || len(payload) < 64 {
+		return nil, ErrInvalidToken
+	}
+
+	footer, err := base64.RawURLEncoding.DecodeString(encodedFooter)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	nonce := payload[:32]
+	ciphertext := payload[32 : len(payload)-32]
+	tag := payload[len(payload)-32:]
+
+	encryptionKey, counterNonce, authKey, err := pasetoSplitKey(secret, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	expectedTag, err := pasetoTag(authKey, nonce, ciphertext, footer)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(tag, expectedTag) {
+		return nil, ErrInvalidToken
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(encryptionKey, counterNonce)
+	if err != nil {
+		return nil, err
+	}
+	message := make([]byte, len(ciphertext))
+	cipher.XORKeyStream(message, ciphertext)
+
+	return message, nil
+}
+
+// pasetoSplitKey derives the encryption key, XChaCha20 nonce and
+// authentication key for a message from the secret key and random nonce.
+func pasetoSplitKey(secret []byte, nonce []byte) ([]byte, []byte, []byte, error) {
+	h, err := blake2b.New(56, secret)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	h.Write([]byte("paseto-encryption-key"))
+	h.Write(nonce)
+	tmp := h.Sum(nil)
+
+	h, err = blake2b.New(32, secret)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	h.Write([]byte("paseto-auth-key-for-aead"))
+	h.Write(nonce)
+	authKey := h.Sum(nil)
+
+	return tmp[:32], tmp[32:], authKey, nil
+}
+
+func pasetoTag(authKey []byte, nonce []byte, ciphertext []byte, footer []byte) ([]byte, error) {
+	h, err := blake2b.New(32, authKey)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(pasetoPAE([]byte("v4.local."), nonce, ciphertext, footer, nil))
+	return h.Sum(nil), nil
+}
+
+// pasetoPAE is the PASETO pre-authentication encoding of the given pieces.
+func pasetoPAE(pieces ...[]byte) []byte {
+	var buf bytes.Buffer
+
+	le64 := func(n int) {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, uint64(n)&^(1<<63))
+		buf.Write(b)
+	}
+
+	le64(len(pieces))
+	for _, piece := range pieces {
+		le64(len(piece))
+		buf.Write(piece)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,323 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/database"
+)
+
+// The v4.local vectors of the PASETO test suite without footer or implicit
+// assertion.
+func TestPasetoVectors(t *testing.T) {
+	secret, _ := hex.DecodeString("707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f")
+	nonce := make([]byte, 32)
+
+	tests := []struct {
+		name    string
+		message string
+		token   string
+	}{
+		{
+			name:    "4-E-1",
+			message: `{"data":"this is a secret message","exp":"2022-01-01T00:00:00+00:00"}`,
+			token:   "v4.local.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAr68PS4AXe7If_ZgesdkUMvSwscFlAl1pk5HC0e8kApeaqMfGo_7OpBnwJOAbY9V7WU6abu74MmcUE8YWAiaArVI8XJ5hOb_4v9RmDkneN0S92dx0OW4pgy7omxgf3S8c3LlQg",
+		},
+		{
+			name:    "4-E-2",
+			message: `{"data":"this is a hidden message","exp":"2022-01-01T00:00:00+00:00"}`,
+			token:   "v4.local.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAr68PS4AXe7If_ZgesdkUMvS2csCgglvpk5HC0e8kApeaqMfGo_7OpBnwJOAbY9V7WU6abu74MmcUE8YWAiaArVI8XIemu9chy3WVKvRBfg6t8wwYHK0ArLxxfZP73W_vfwt5A",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := pasetoSeal(secret, nonce, []byte(tt.message), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != tt.token {
+				t.Errorf("got token %q; want %q", token, tt.token)
+			}
+
+			message, err := pasetoOpen(secret, tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(message) != tt.message {
+				t.Errorf("got message %q; want %q", message, tt.message)
+			}
+		})
+	}
+}
+
+func TestPasetoOpenRejectsTampering(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, 32)
+	nonce := bytes.Repeat([]byte{2}, 32)
+
+	token, err := pasetoSeal(secret, nonce, []byte(`{"sub":"a"}`), []byte(`{"kid":"a"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, footer, _ := strings.Cut(strings.TrimPrefix(token, pasetoHeader), ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(body)
+
+	flipped := bytes.Clone(payload)
+	flipped[40] ^= 1
+
+	tests := []struct {
+		name   string
+		secret []byte
+		token  string
+	}{
+		{"wrong key", bytes.Repeat([]byte{3}, 32), token},
+		{"modified ciphertext", secret, pasetoHeader + base64.RawURLEncoding.EncodeToString(flipped) + "." + footer},
+		{"modified footer", secret, pasetoHeader + body + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"kid":"b"}`))},
+		{"missing footer", secret, pasetoHeader + body},
+		{"wrong header", secret, "v4.public." + body + "." + footer},
+		{"truncated", secret, token[:len(pasetoHeader)+60]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := pasetoOpen(tt.secret, tt.token)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got error %v; want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestPasetoKeyRotation(t *testing.T) {
+	oldKey := Key{ID: "old", Secret: bytes.Repeat([]byte{1}, 32)}
+	newKey := Key{ID: "new", Secret: bytes.Repeat([]byte{2}, 32)}
+
+	before, err := NewPaseto([]Key{oldKey}, false, database.Models{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := NewPaseto([]Key{newKey, oldKey}, false, database.Models{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldToken := newTestToken(t, before)
+	newToken := newTestToken(t, after)
+
+	if kid := footerKeyID(t, oldToken.Plaintext); kid != oldKey.ID {
+		t.Errorf("got key ID %q before rotation; want %q", kid, oldKey.ID)
+	}
+	if kid := footerKeyID(t, newToken.Plaintext); kid != newKey.ID {
+		t.Errorf("got key ID %q after rotation; want %q", kid, newKey.ID)
+	}
+
+	claims, err := after.decrypt(oldToken.Plaintext)
+	if err != nil {
+		t.Fatalf("token issued before the rotation: %v", err)
+	}
+	if claims.Subject != oldToken.UserID || claims.Session != oldToken.Family {
+		t.Errorf("got subject %s and session %s; want %s and %s", claims.Subject, claims.Session, oldToken.UserID, oldToken.Family)
+	}
+
+	_, err = after.decrypt(newToken.Plaintext)
+	if err != nil {
+		t.Fatalf("token issued after the rotation: %v", err)
+	}
+
+	// Instances that don't know the new key yet can't verify its tokens.
+	_, err = before.decrypt(newToken.Plaintext)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("got error %v; want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestPasetoKeyIDLookup(t *testing.T) {
+	key := Key{ID: "a", Secret: bytes.Repeat([]byte{1}, 32)}
+
+	s, err := NewPaseto([]Key{key}, false, database.Models{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  Key
+	}{
+		{"unknown key ID", Key{ID: "b", Secret: key.Secret}},
+		{"known key ID with another secret", Key{ID: "a", Secret: bytes.Repeat([]byte{2}, 32)}},
+		{"empty key ID", Key{ID: "", Secret: key.Secret}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forged, err := NewPaseto([]Key{tt.key}, false, database.Models{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token := newTestToken(t, forged)
+
+			_, err = s.decrypt(token.Plaintext)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got error %v; want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+// TestPasetoDenylist needs a migrated database, whose DSN it reads from
+// TEST_DB_DSN. It is skipped without one.
+func TestPasetoDenylist(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN not set")
+	}
+
+	db, err := database.Init(&database.Config{Dsn: dsn, MaxOpenConns: 2, MaxIdleTime: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	// The cache makes sure revoking drops sessions that were already
+	// looked up.
+	cache := database.NewCache(db, database.CacheConfig{Size: 100, TTL: time.Minute})
+	models := database.NewModels(db, cache)
+
+	user := &database.User{
+		FirstName: "Paseto",
+		LastName:  "Test",
+		Email:     uuid.NewString() + "@example.com",
+		Activated: true,
+	}
+	err = user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { models.Users.Delete(user.ID) })
+
+	s, err := NewPaseto([]Key{{ID: "a", Secret: bytes.Repeat([]byte{1}, 32)}}, true, models)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issue := func() *database.Token {
+		token, err := database.GenerateToken(user.ID, 15*time.Minute, database.ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Issue(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = s.Authenticate(token.Plaintext)
+		if err != nil {
+			t.Fatalf("fresh token: %v", err)
+		}
+		return token
+	}
+
+	t.Run("Revoke", func(t *testing.T) {
+		revoked := issue()
+		other := issue()
+
+		err := s.Revoke(user.ID, revoked.Family)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = s.Authenticate(revoked.Plaintext)
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("revoked family: got error %v; want %v", err, ErrInvalidToken)
+		}
+		_, _, err = s.Authenticate(other.Plaintext)
+		if err != nil {
+			t.Errorf("other family: %v", err)
+		}
+	})
+
+	t.Run("Revoke another user's family", func(t *testing.T) {
+		token := issue()
+
+		err := s.Revoke(uuid.New(), token.Family)
+		if !errors.Is(err, database.ErrRecordNotFound) {
+			t.Errorf("got error %v; want %v", err, database.ErrRecordNotFound)
+		}
+
+		_, _, err = s.Authenticate(token.Plaintext)
+		if err != nil {
+			t.Errorf("family of another user: %v", err)
+		}
+	})
+
+	// None of the families has a refresh token, so RevokeAll has to rely on
+	// the families tracked when the tokens were issued.
+	t.Run("RevokeAll", func(t *testing.T) {
+		first := issue()
+		second := issue()
+
+		err := s.RevokeAll(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, token := range []*database.Token{first, second} {
+			_, _, err = s.Authenticate(token.Plaintext)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got error %v; want %v", err, ErrInvalidToken)
+			}
+		}
+
+		_, _, err = s.Authenticate(issue().Plaintext)
+		if err != nil {
+			t.Errorf("token issued after RevokeAll: %v", err)
+		}
+	})
+}
+
+func newTestToken(t *testing.T, s *Paseto) *database.Token {
+	t.Helper()
+
+	token, err := database.GenerateToken(uuid.New(), 15*time.Minute, database.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Issue(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func footerKeyID(t *testing.T, token string) string {
+	t.Helper()
+
+	_, footer, _ := strings.Cut(strings.TrimPrefix(token, pasetoHeader), ".")
+	decoded, err := base64.RawURLEncoding.DecodeString(footer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var f pasetoFooter
+	err = json.Unmarshal(decoded, &f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f.KeyID
+}
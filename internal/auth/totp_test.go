@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// The secret of the RFC 4226 and RFC 6238 test vectors.
+var rfcSecret = []byte("12345678901234567890")
+
+// RFC 4226, Appendix D.
+func TestHOTP(t *testing.T) {
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+
+	for counter, code := range want {
+		if got := hotp(rfcSecret, int64(counter)); got != code {
+			t.Errorf("counter %d: got %q; want %q", counter, got, code)
+		}
+	}
+}
+
+// RFC 6238, Appendix B, for SHA-1 and truncated to six digits.
+func TestValidateTOTPVectors(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		step, ok := ValidateTOTP(rfcSecret, tt.code, time.Unix(tt.unix, 0), 0)
+		if !ok {
+			t.Errorf("time %d: code %q rejected", tt.unix, tt.code)
+			continue
+		}
+		if want := tt.unix / totpPeriod; step != want {
+			t.Errorf("time %d: got step %d; want %d", tt.unix, step, want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		ok       bool
+	}{
+		{"current step", hotp(rfcSecret, current), 0, true},
+		{"previous step", hotp(rfcSecret, current-1), 0, true},
+		{"next step", hotp(rfcSecret, current+1), 0, true},
+		{"too old", hotp(rfcSecret, current-2), 0, false},
+		{"too new", hotp(rfcSecret, current+2), 0, false},
+		{"replayed", hotp(rfcSecret, current), current, false},
+		{"older than last step", hotp(rfcSecret, current-1), current, false},
+		{"newer than last step", hotp(rfcSecret, current+1), current, true},
+		{"wrong code", "000000", 0, false},
+		{"too short", hotp(rfcSecret, current)[:5], 0, false},
+		{"too long", hotp(rfcSecret, current) + "0", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := ValidateTOTP(rfcSecret, tt.code, now, tt.lastStep)
+			if ok != tt.ok {
+				t.Errorf("got %t; want %t", ok, tt.ok)
+			}
+		})
+	}
+}
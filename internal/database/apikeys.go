@@ -0,0 +1,238 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+// APIKeyPrefix starts every API key so they are easy to recognise, e.g. by
+// secret scanners.
+const APIKeyPrefix = "grt_"
+
+type APIKey struct {
+	ID          uuid.UUID   `json:"id"`
+	UserID      uuid.UUID   `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+type APIKeyModel struct {
+	DB *pgxpool.Pool
+}
+
+func GenerateAPIKey(userID uuid.UUID, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Permissions: permissions,
+		Expiry:      expiry,
+	}
+
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Plaintext = APIKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Prefix = key.Plaintext[:len(APIKeyPrefix)+8]
+	key.Hash = hashTokenPlaintext(key.Plaintext)
+
+	return key, nil
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(strings.HasPrefix(keyPlaintext, APIKeyPrefix), "key", "must be a valid API key")
+	v.Check(len(keyPlaintext) == len(APIKeyPrefix)+52, "key", "must be a valid API key")
+}
+
+// ValidateAPIKey checks the key against the permissions of the user creating
+// it; a key can never grant more than its owner has.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, userPermissions Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range key.Permissions {
+		v.Check(userPermissions.Includes(code), "permissions", "must only contain permissions you have")
+	}
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+func (m APIKeyModel) Insert(key *APIKey) error {
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, []string(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+func (m APIKeyModel) GetAllForUser(userID uuid.UUID) ([]*APIKey, error) {
+	query := `
+		SELECT id, user_id, name, prefix, permissions, expiry, created_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY created_at DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var permissions []string
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			&permissions,
+			&key.Expiry,
+			&key.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		key.Permissions = permissions
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (m APIKeyModel) DeleteForUser(id uuid.UUID, userID uuid.UUID) error {
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllForUser deletes every API key of the user.
+func (m APIKeyModel) DeleteAllForUser(userID uuid.UUID) error {
+	query := `
+		DELETE FROM api_keys
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
+
+// GetUserByKey returns the owner of an unexpired API key together with the
+// key itself.
+func (m APIKeyModel) GetUserByKey(keyPlaintext string) (*User, *APIKey, error) {
+	query := `
+		SELECT
+	    users.id,
+	    users.email,
+	    users.first_name,
+	    users.last_name,
+	    users.password_hash,
+	    users.created_at,
+	    users.last_updated,
+	    users.activated,
+	    users.totp_enabled,
+	    users.disabled_at,
+	    api_keys.id,
+	    api_keys.name,
+	    api_keys.prefix,
+	    api_keys.permissions,
+	    api_keys.expiry,
+	    api_keys.created_at
+		FROM users
+		INNER JOIN api_keys
+		ON users.id = api_keys.user_id
+		WHERE api_keys.hash = $1
+		AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)
+		AND users.disabled_at IS NULL`
+
+	args := []any{hashTokenPlaintext(keyPlaintext), time.Now()}
+
+	var user User
+	var key APIKey
+	var permissions []string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password.hash,
+		&user.CreatedAt,
+		&user.LastUpdated,
+		&user.Activated,
+		&user.MFAEnabled,
+		&user.DisabledAt,
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		&permissions,
+		&key.Expiry,
+		&key.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	key.UserID = user.ID
+	key.Permissions = permissions
+
+	return &user, &key, nil
+}
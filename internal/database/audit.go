@@ -0,0 +1,203 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type AuditEventType string
+
+const (
+	AuditUserRegistered       AuditEventType = "user.registered"
+	AuditUserActivated        AuditEventType = "user.activated"
+	AuditUserUpdated          AuditEventType = "user.updated"
+	AuditUserDisabled         AuditEventType = "user.disabled"
+	AuditUserDeleted          AuditEventType = "user.deleted"
+	AuditDeletionScheduled    AuditEventType = "user.deletion_scheduled"
+	AuditDeletionCancelled    AuditEventType = "user.deletion_cancelled"
+	AuditEmailChangeRequested AuditEventType = "email_change.requested"
+	AuditEmailChangeConfirmed AuditEventType = "email_change.confirmed"
+	AuditEmailChangeCancelled AuditEventType = "email_change.cancelled"
+	AuditLoginSucceeded       AuditEventType = "login.succeeded"
+	AuditLoginFailed          AuditEventType = "login.failed"
+	AuditLoginReported        AuditEventType = "login.reported"
+	AuditLockoutCleared       AuditEventType = "lockout.cleared"
+	AuditMFAEnabled           AuditEventType = "mfa.enabled"
+	AuditMFADisabled          AuditEventType = "mfa.disabled"
+	AuditMFAFailed            AuditEventType = "mfa.failed"
+	AuditTokenCreated         AuditEventType = "token.created"
+	AuditAPIKeyCreated        AuditEventType = "api_key.created"
+	AuditAPIKeyDeleted        AuditEventType = "api_key.deleted"
+	AuditPasswordReset        AuditEventType = "password.reset"
+	AuditPasswordChanged      AuditEventType = "password.changed"
+	AuditPermissionCreated    AuditEventType = "permission.created"
+	AuditPermissionUpdated    AuditEventType = "permission.updated"
+	AuditPermissionDeleted    AuditEventType = "permission.deleted"
+	AuditPermissionsGranted   AuditEventType = "permissions.granted"
+	AuditPermissionRevoked    AuditEventType = "permission.revoked"
+	AuditRoleCreated          AuditEventType = "role.created"
+	AuditRoleUpdated          AuditEventType = "role.updated"
+	AuditRoleDeleted          AuditEventType = "role.deleted"
+	AuditRolesAssigned        AuditEventType = "roles.assigned"
+	AuditRoleRemoved          AuditEventType = "role.removed"
+	AuditInvitationCreated    AuditEventType = "invitation.created"
+	AuditInvitationDeleted    AuditEventType = "invitation.deleted"
+	AuditImpersonationStarted AuditEventType = "impersonation.started"
+)
+
+// AuditEvent records a security-relevant action. ActorID is the user who
+// performed it, if known, and TargetID the user it was performed on. The
+// IDs aren't foreign keys so that events outlive the users they mention.
+type AuditEvent struct {
+	ID             uuid.UUID      `json:"id"`
+	Type           AuditEventType `json:"type"`
+	ActorID        *uuid.UUID     `json:"actor_id"`
+	ImpersonatorID *uuid.UUID     `json:"impersonator_id,omitempty"`
+	TargetID       *uuid.UUID     `json:"target_id"`
+	IPAddress      string         `json:"ip_address"`
+	UserAgent      string         `json:"user_agent"`
+	Metadata       map[string]any `json:"metadata"`
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+type AuditModel struct {
+	DB *pgxpool.Pool
+}
+
+func (m AuditModel) Insert(event *AuditEvent) error {
+	query := `
+		INSERT INTO audit_events (type, actor_id, impersonator_id, target_id, ip_address, user_agent, metadata)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`
+
+	if event.Metadata == nil {
+		event.Metadata = map[string]any{}
+	}
+
+	args := []any{
+		event.Type,
+		event.ActorID,
+		event.ImpersonatorID,
+		event.TargetID,
+		event.IPAddress,
+		event.UserAgent,
+		event.Metadata,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// AuditFilter narrows down the events listed by GetAll. Empty fields don't
+// filter anything.
+type AuditFilter struct {
+	Type          AuditEventType
+	ActorID       *uuid.UUID
+	TargetID      *uuid.UUID
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+// GetAll returns the events matching the filter, newest first.
+func (m AuditModel) GetAll(filter AuditFilter, filters CursorFilters) ([]*AuditEvent, CursorMetadata, error) {
+	query := `
+		SELECT id, type, actor_id, impersonator_id, target_id, ip_address, user_agent, metadata, created_at
+		FROM audit_events
+		WHERE ($1 = '' OR type = $1)
+		AND ($2::uuid IS NULL OR actor_id = $2)
+		AND ($3::uuid IS NULL OR target_id = $3)
+		AND ($4::timestamptz IS NULL OR created_at >= $4)
+		AND ($5::timestamptz IS NULL OR created_at < $5)
+		AND ($6::uuid IS NULL OR id < $6)
+		ORDER BY id DESC
+		LIMIT $7`
+
+	// One more event than asked for tells whether there is another page.
+	args := []any{
+		filter.Type,
+		filter.ActorID,
+		filter.TargetID,
+		filter.CreatedAfter,
+		filter.CreatedBefore,
+		filters.Cursor,
+		filters.PageSize + 1,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, CursorMetadata{}, err
+	}
+
+	events, err := scanAuditEvents(rows)
+	if err != nil {
+		return nil, CursorMetadata{}, err
+	}
+
+	metadata := CursorMetadata{PageSize: filters.PageSize}
+
+	if len(events) > filters.PageSize {
+		events = events[:filters.PageSize]
+		metadata.NextCursor = &events[len(events)-1].ID
+	}
+
+	return events, metadata, nil
+}
+
+// GetAllForUser returns every event the user performed or was the target
+// of, oldest first.
+func (m AuditModel) GetAllForUser(userID uuid.UUID) ([]*AuditEvent, error) {
+	query := `
+		SELECT id, type, actor_id, impersonator_id, target_id, ip_address, user_agent, metadata, created_at
+		FROM audit_events
+		WHERE actor_id = $1 OR target_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAuditEvents(rows)
+}
+
+func scanAuditEvents(rows pgx.Rows) ([]*AuditEvent, error) {
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	for rows.Next() {
+		var event AuditEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.Type,
+			&event.ActorID,
+			&event.ImpersonatorID,
+			&event.TargetID,
+			&event.IPAddress,
+			&event.UserAgent,
+			&event.Metadata,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -0,0 +1,233 @@
+package database
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/lieberdev/go-rest-template/internal/cache"
+)
+
+// cacheChannel is the Postgres notification channel invalidations are
+// published on when CacheConfig.Notify is set.
+const cacheChannel = "cache_invalidation"
+
+type CacheConfig struct {
+	Size int
+	TTL  time.Duration
+	// Notify publishes every invalidation through Postgres NOTIFY so that
+	// other instances listening with Cache.Listen drop their entries too.
+	Notify bool
+}
+
+// Cache holds the results of the lookups every authenticated request makes:
+// the user and token behind an authentication token, and the user's
+// permissions. The models invalidate it whenever they change what it holds.
+// A nil *Cache caches nothing.
+type Cache struct {
+	db          *pgxpool.Pool
+	notify      bool
+	sessions    *cache.Cache[string, session]
+	permissions *cache.Cache[uuid.UUID, Permissions]
+}
+
+type session struct {
+	user  User
+	token Token
+}
+
+// NewCache returns nil, disabling caching, if the size or time to live
+// isn't positive.
+func NewCache(db *pgxpool.Pool, cfg CacheConfig) *Cache {
+	if cfg.Size <= 0 || cfg.TTL <= 0 {
+		return nil
+	}
+
+	return &Cache{
+		db:          db,
+		notify:      cfg.Notify,
+		sessions:    cache.New[string, session](cfg.Size, cfg.TTL),
+		permissions: cache.New[uuid.UUID, Permissions](cfg.Size, cfg.TTL),
+	}
+}
+
+// Stats returns the hit and miss counts of the session and permission
+// caches.
+func (c *Cache) Stats() map[string]cache.Stats {
+	if c == nil {
+		return nil
+	}
+
+	return map[string]cache.Stats{
+		"sessions":    c.sessions.Stats(),
+		"permissions": c.permissions.Stats(),
+	}
+}
+
+func (c *Cache) getSession(tokenHash []byte, load func() (*User, *Token, error)) (*User, *Token, error) {
+	if c == nil {
+		return load()
+	}
+
+	s, err := c.sessions.GetOrLoad(string(tokenHash), func() (session, error) {
+		user, token, err := load()
+		if err != nil {
+			return session{}, err
+		}
+		return session{user: *user, token: *token}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A cached token may expire before its entry does.
+	if time.Now().After(s.token.Expiry) {
+		c.sessions.Delete(string(tokenHash))
+		return nil, nil, ErrRecordNotFound
+	}
+
+	// Callers get their own copies so that changing them doesn't change
+	// what other requests get from the cache.
+	return &s.user, &s.token, nil
+}
+
+func (c *Cache) getPermissions(userID uuid.UUID, load func() (Permissions, error)) (Permissions, error) {
+	if c == nil {
+		return load()
+	}
+
+	permissions, err := c.permissions.GetOrLoad(userID, load)
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.Clone(permissions), nil
+}
+
+// invalidateUser drops the cached sessions of the user, e.g. because tokens
+// were revoked or the user changed.
+func (c *Cache) invalidateUser(userID uuid.UUID) error {
+	if c == nil {
+		return nil
+	}
+
+	c.deleteSessions(userID)
+	return c.publish("sessions:" + userID.String())
+}
+
+// invalidateFamily drops the cached sessions of a token family, e.g.
+// because the family was denylisted.
+func (c *Cache) invalidateFamily(family uuid.UUID) error {
+	if c == nil {
+		return nil
+	}
+
+	c.deleteFamily(family)
+	return c.publish("family:" + family.String())
+}
+
+// invalidatePermissions drops the cached permissions of the user.
+func (c *Cache) invalidatePermissions(userID uuid.UUID) error {
+	if c == nil {
+		return nil
+	}
+
+	c.permissions.Delete(userID)
+	return c.publish("permissions:" + userID.String())
+}
+
+// invalidateAll drops everything, for changes that may affect any user
+// such as a role or permission code changing.
+func (c *Cache) invalidateAll() error {
+	if c == nil {
+		return nil
+	}
+
+	c.clear()
+	return c.publish("all")
+}
+
+func (c *Cache) deleteSessions(userID uuid.UUID) {
+	c.sessions.DeleteFunc(func(_ string, s session) bool {
+		return s.user.ID == userID
+	})
+}
+
+func (c *Cache) deleteFamily(family uuid.UUID) {
+	c.sessions.DeleteFunc(func(_ string, s session) bool {
+		return s.token.Family == family
+	})
+}
+
+func (c *Cache) clear() {
+	c.sessions.Clear()
+	c.permissions.Clear()
+}
+
+func (c *Cache) publish(payload string) error {
+	if !c.notify {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := c.db.Exec(ctx, `SELECT pg_notify($1, $2)`, cacheChannel, payload)
+	return err
+}
+
+// Listen applies the invalidations published by every instance, including
+// this one, until the context is cancelled or the connection fails. As
+// invalidations may have been missed before it started listening, it
+// clears the cache once it does.
+func (c *Cache) Listen(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+
+	conn, err := c.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "LISTEN "+cacheChannel)
+	if err != nil {
+		return err
+	}
+
+	c.clear()
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		c.apply(notification.Payload)
+	}
+}
+
+func (c *Cache) apply(payload string) {
+	kind, id, _ := strings.Cut(payload, ":")
+
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		c.clear()
+		return
+	}
+
+	switch kind {
+	case "sessions":
+		c.deleteSessions(uid)
+	case "family":
+		c.deleteFamily(uid)
+	case "permissions":
+		c.permissions.Delete(uid)
+	default:
+		c.clear()
+	}
+}
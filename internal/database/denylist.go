@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DenylistModel keeps track of revoked token families whose tokens are not
+// stored in the database, like signed stateless tokens, until they expire.
+// To be able to revoke every session of a user, it also keeps track of the
+// families issued to each user.
+type DenylistModel struct {
+	DB    *pgxpool.Pool
+	Cache *Cache
+}
+
+// Track records that tokens of the family were issued to the user and stay
+// valid until expiry.
+func (m DenylistModel) Track(userID uuid.UUID, family uuid.UUID, expiry time.Time) error {
+	query := `
+		INSERT INTO token_families (family, user_id, expiry)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (family) DO UPDATE
+		SET expiry = GREATEST(token_families.expiry, EXCLUDED.expiry)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, family, userID, expiry)
+
+	return err
+}
+
+// Insert denylists a family that was issued to the user. It returns
+// ErrRecordNotFound if the user has no such family, so that nobody can
+// revoke someone else's tokens by guessing the family.
+func (m DenylistModel) Insert(userID uuid.UUID, family uuid.UUID, expiry time.Time) error {
+	query := `
+		INSERT INTO token_denylist (family, expiry)
+		SELECT family, $3
+		FROM token_families
+		WHERE family = $1 AND user_id = $2
+		ON CONFLICT (family) DO UPDATE
+		SET expiry = GREATEST(token_denylist.expiry, EXCLUDED.expiry)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, query, family, userID, expiry)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM token_families WHERE family = $1 AND user_id = $2`, family, userID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidateFamily(family)
+}
+
+// InsertAllForUser denylists every unexpired family issued to the user,
+// whether or not the user still holds a refresh token of it.
+func (m DenylistModel) InsertAllForUser(userID uuid.UUID, expiry time.Time) error {
+	query := `
+		INSERT INTO token_denylist (family, expiry)
+		SELECT family, $2
+		FROM token_families
+		WHERE user_id = $1 AND expiry > $3
+		ON CONFLICT (family) DO UPDATE
+		SET expiry = GREATEST(token_denylist.expiry, EXCLUDED.expiry)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, query, userID, expiry, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM token_families WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidateUser(userID)
+}
+
+func (m DenylistModel) Contains(family uuid.UUID) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM token_denylist
+			WHERE family = $1 AND expiry > $2
+		)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRow(ctx, query, family, time.Now()).Scan(&exists)
+
+	return exists, err
+}
+
+// DeleteExpired deletes the denylist entries and tracked families that
+// have expired.
+func (m DenylistModel) DeleteExpired() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, `DELETE FROM token_denylist WHERE expiry <= $1`, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.Exec(ctx, `DELETE FROM token_families WHERE expiry <= $1`, time.Now())
+
+	return err
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// EmailChange is a user's request to move their account to a new email
+// address. It is kept after being confirmed until it expires, so the owner
+// of the old address can still undo it.
+type EmailChange struct {
+	UserID      uuid.UUID
+	OldEmail    string
+	NewEmail    string
+	ConfirmedAt *time.Time
+	Expiry      time.Time
+	CreatedAt   time.Time
+}
+
+type EmailChangeModel struct {
+	DB *pgxpool.Pool
+}
+
+// Insert stores the change, replacing any earlier change of the user.
+func (m EmailChangeModel) Insert(change *EmailChange) error {
+	query := `
+		INSERT INTO email_changes (user_id, old_email, new_email, expiry)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET old_email = EXCLUDED.old_email,
+		    new_email = EXCLUDED.new_email,
+		    confirmed_at = NULL,
+		    expiry = EXCLUDED.expiry,
+		    created_at = NOW()
+		RETURNING created_at`
+
+	args := []any{change.UserID, change.OldEmail, change.NewEmail, change.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&change.CreatedAt)
+}
+
+func (m EmailChangeModel) GetForUser(userID uuid.UUID) (*EmailChange, error) {
+	query := `
+		SELECT user_id, old_email, new_email, confirmed_at, expiry, created_at
+		FROM email_changes
+		WHERE user_id = $1 AND expiry > $2`
+
+	var change EmailChange
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, userID, time.Now()).Scan(
+		&change.UserID,
+		&change.OldEmail,
+		&change.NewEmail,
+		&change.ConfirmedAt,
+		&change.Expiry,
+		&change.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &change, nil
+}
+
+func (m EmailChangeModel) Confirm(change *EmailChange) error {
+	query := `
+		UPDATE email_changes
+		SET confirmed_at = $1
+		WHERE user_id = $2 AND confirmed_at IS NULL
+		RETURNING confirmed_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, time.Now(), change.UserID).Scan(&change.ConfirmedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m EmailChangeModel) DeleteForUser(userID uuid.UUID) error {
+	query := `
+		DELETE FROM email_changes
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
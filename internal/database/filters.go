@@ -0,0 +1,98 @@
+package database
+
+import (
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+// Filters holds the pagination and sorting parameters of a list request.
+// Sort must be one of SortSafelist, optionally prefixed with "-" to sort in
+// descending order.
+type Filters struct {
+	Page         int
+	PageSize     int
+	Sort         string
+	SortSafelist []string
+}
+
+// Metadata describes the page of results a list response holds.
+type Metadata struct {
+	CurrentPage  int `json:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty"`
+	TotalRecords int `json:"total_records"`
+}
+
+func ValidateFilters(v *validator.Validator, f Filters) {
+	v.Check(f.Page > 0, "page", "must be greater than zero")
+	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
+	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
+	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+
+	v.Check(slices.Contains(f.SortSafelist, f.Sort), "sort", "invalid sort value")
+}
+
+// sortColumn returns the column to sort by. The sort value has been checked
+// against the safelist by ValidateFilters, so this only panics on a bug.
+func (f Filters) sortColumn() string {
+	if slices.Contains(f.SortSafelist, f.Sort) {
+		return strings.TrimPrefix(f.Sort, "-")
+	}
+
+	panic("unsafe sort parameter: " + f.Sort)
+}
+
+func (f Filters) sortDirection() string {
+	if strings.HasPrefix(f.Sort, "-") {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+func (f Filters) limit() int {
+	return f.PageSize
+}
+
+func (f Filters) offset() int {
+	return (f.Page - 1) * f.PageSize
+}
+
+func calculateMetadata(totalRecords, page, pageSize int) Metadata {
+	if totalRecords == 0 {
+		return Metadata{}
+	}
+
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		TotalRecords: totalRecords,
+	}
+}
+
+// CursorFilters holds the pagination parameters of a list request that
+// pages by cursor rather than page number, for tables that grow too fast for
+// page numbers to be stable. Cursor is the ID of the last record of the
+// previous page, or nil for the first page.
+type CursorFilters struct {
+	Cursor   *uuid.UUID
+	PageSize int
+}
+
+// CursorMetadata describes a page of results. NextCursor is nil on the last
+// page.
+type CursorMetadata struct {
+	PageSize   int        `json:"page_size"`
+	NextCursor *uuid.UUID `json:"next_cursor"`
+}
+
+func ValidateCursorFilters(v *validator.Validator, f CursorFilters) {
+	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
+	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+}
@@ -2,9 +2,11 @@ package database
 
 import "fmt"
 
+// UniqueConstraint returns the error message Postgres reports when an insert
+// or update violates the unique constraint on table.field.
 func UniqueConstraint(table string, field string) string {
 	return fmt.Sprintf(
-		`pq: duplicate key value violates unique constraint "%s_%s_key"`,
+		`ERROR: duplicate key value violates unique constraint "%s_%s_key" (SQLSTATE 23505)`,
 		table,
 		field,
 	)
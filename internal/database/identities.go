@@ -0,0 +1,179 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Identity links a user to an account at an external OpenID Connect
+// provider.
+type Identity struct {
+	ID        uuid.UUID `json:"id"`
+	UserID    uuid.UUID `json:"-"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"-"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OIDCState is an authorization request that has been sent to a provider
+// and is waiting for the user to come back with an authorization code.
+type OIDCState struct {
+	Plaintext    string
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+	Expiry       time.Time
+}
+
+type IdentityModel struct {
+	DB *pgxpool.Pool
+}
+
+func (m IdentityModel) Insert(identity *Identity) error {
+	query := `
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+
+	args := []any{identity.UserID, identity.Provider, identity.Subject, identity.Email}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&identity.ID, &identity.CreatedAt)
+}
+
+func (m IdentityModel) Get(provider string, subject string) (*Identity, error) {
+	query := `
+		SELECT id, user_id, provider, subject, email, created_at
+		FROM user_identities
+		WHERE provider = $1 AND subject = $2`
+
+	var identity Identity
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, provider, subject).Scan(
+		&identity.ID,
+		&identity.UserID,
+		&identity.Provider,
+		&identity.Subject,
+		&identity.Email,
+		&identity.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &identity, nil
+}
+
+func (m IdentityModel) GetAllForUser(userID uuid.UUID) ([]*Identity, error) {
+	query := `
+		SELECT id, user_id, provider, subject, email, created_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+	for rows.Next() {
+		var identity Identity
+		err := rows.Scan(
+			&identity.ID,
+			&identity.UserID,
+			&identity.Provider,
+			&identity.Subject,
+			&identity.Email,
+			&identity.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, &identity)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+func (m IdentityModel) InsertState(state *OIDCState) error {
+	query := `
+		INSERT INTO oidc_states (hash, provider, code_verifier, nonce, expiry)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	args := []any{
+		hashTokenPlaintext(state.Plaintext),
+		state.Provider,
+		state.CodeVerifier,
+		state.Nonce,
+		state.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, args...)
+
+	return err
+}
+
+// ConsumeState deletes and returns an unexpired authorization request, so
+// each state value can only be redeemed once.
+func (m IdentityModel) ConsumeState(provider string, statePlaintext string) (*OIDCState, error) {
+	query := `
+		DELETE FROM oidc_states
+		WHERE hash = $1 AND provider = $2
+		RETURNING code_verifier, nonce, expiry`
+
+	state := OIDCState{
+		Plaintext: statePlaintext,
+		Provider:  provider,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, hashTokenPlaintext(statePlaintext), provider).Scan(
+		&state.CodeVerifier,
+		&state.Nonce,
+		&state.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if time.Now().After(state.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &state, nil
+}
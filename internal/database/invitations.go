@@ -0,0 +1,254 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+// Invitation lets whoever owns the email address register without having
+// to activate their account, and grants them the invitation's permissions.
+// Like tokens, only the hash of the plaintext is stored.
+type Invitation struct {
+	ID          uuid.UUID   `json:"id"`
+	Email       string      `json:"email"`
+	Permissions Permissions `json:"permissions"`
+	Plaintext   string      `json:"-"`
+	Hash        []byte      `json:"-"`
+	InvitedBy   *uuid.UUID  `json:"invited_by"`
+	Expiry      time.Time   `json:"expiry"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+type InvitationModel struct {
+	DB *pgxpool.Pool
+}
+
+// GenerateInvitation creates an invitation with a new plaintext token that
+// is valid for ttl.
+func GenerateInvitation(email string, permissions Permissions, invitedBy uuid.UUID, ttl time.Duration) (*Invitation, error) {
+	plaintext, err := generateTokenPlaintext()
+	if err != nil {
+		return nil, err
+	}
+
+	invitation := &Invitation{
+		Email:       email,
+		Permissions: permissions,
+		Plaintext:   plaintext,
+		Hash:        hashTokenPlaintext(plaintext),
+		InvitedBy:   &invitedBy,
+		Expiry:      time.Now().Add(ttl),
+	}
+
+	return invitation, nil
+}
+
+// ValidateInvitation checks the invitation against the codes of all
+// existing permissions.
+func ValidateInvitation(v *validator.Validator, invitation *Invitation, permissions Permissions) {
+	ValidateEmail(v, invitation.Email)
+
+	v.Check(validator.Unique(invitation.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range invitation.Permissions {
+		v.Check(slices.Contains(permissions, code), "permissions", "must only contain existing permissions")
+	}
+}
+
+// Insert stores the invitation, replacing any earlier invitation of the
+// same email address.
+func (m InvitationModel) Insert(invitation *Invitation) error {
+	query := `
+		INSERT INTO invitations (email, permissions, hash, invited_by, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (email) DO UPDATE
+		SET permissions = EXCLUDED.permissions, hash = EXCLUDED.hash, invited_by = EXCLUDED.invited_by,
+		  expiry = EXCLUDED.expiry, created_at = NOW()
+		RETURNING id, created_at`
+
+	args := []any{
+		invitation.Email,
+		[]string(invitation.Permissions),
+		invitation.Hash,
+		invitation.InvitedBy,
+		invitation.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+// GetByToken returns the unexpired invitation with the plaintext token.
+func (m InvitationModel) GetByToken(tokenPlaintext string) (*Invitation, error) {
+	query := `
+		SELECT id, email, permissions, hash, invited_by, expiry, created_at
+		FROM invitations
+		WHERE hash = $1 AND expiry > $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	invitation, err := scanUserInvitation(m.DB.QueryRow(ctx, query, hashTokenPlaintext(tokenPlaintext), time.Now()))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	invitation.Plaintext = tokenPlaintext
+
+	return invitation, nil
+}
+
+// GetAll returns every unexpired invitation, newest first.
+func (m InvitationModel) GetAll() ([]*Invitation, error) {
+	query := `
+		SELECT id, email, permissions, hash, invited_by, expiry, created_at
+		FROM invitations
+		WHERE expiry > $1
+		ORDER BY created_at DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []*Invitation{}
+	for rows.Next() {
+		invitation, err := scanUserInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+// Accept registers the invited user, gives them the default roles and the
+// invitation's permissions and deletes the invitation, all in one
+// transaction. It returns ErrRecordNotFound if the invitation was accepted
+// or deleted meanwhile.
+func (m InvitationModel) Accept(invitation *Invitation, user *User, roles []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, `DELETE FROM invitations WHERE id = $1`, invitation.ID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		INSERT INTO users (email, first_name, last_name, password_hash, activated)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, last_updated`
+
+	args := []any{user.Email, user.FirstName, user.LastName, user.Password.hash, user.Activated}
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.LastUpdated)
+	if err != nil {
+		switch {
+		case err.Error() == UniqueConstraint("users", "email"):
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	query = `
+		INSERT INTO users_roles
+		SELECT $1, roles.id
+		FROM roles
+		WHERE roles.name = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	_, err = tx.Exec(ctx, query, user.ID, roles)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id
+		FROM permissions
+		WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	_, err = tx.Exec(ctx, query, user.ID, []string(invitation.Permissions))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func scanUserInvitation(row pgx.Row) (*Invitation, error) {
+	var invitation Invitation
+	var permissions []string
+
+	err := row.Scan(
+		&invitation.ID,
+		&invitation.Email,
+		&permissions,
+		&invitation.Hash,
+		&invitation.InvitedBy,
+		&invitation.Expiry,
+		&invitation.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	invitation.Permissions = permissions
+
+	return &invitation, nil
+}
+
+func (m InvitationModel) Delete(id uuid.UUID) error {
+	query := `
+		DELETE FROM invitations
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// LoginEvent records a successful login. Session is the token family the
+// login started, which is unknown for logins recorded before it was kept.
+// NewDevice is set when the login came from a device or IP address the user
+// hadn't logged in from before.
+type LoginEvent struct {
+	ID          uuid.UUID  `json:"id"`
+	UserID      uuid.UUID  `json:"-"`
+	Session     *uuid.UUID `json:"session"`
+	IPAddress   string     `json:"ip_address"`
+	UserAgent   string     `json:"user_agent"`
+	Fingerprint string     `json:"fingerprint"`
+	NewDevice   bool       `json:"new_device"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+type LoginModel struct {
+	DB *pgxpool.Pool
+}
+
+var versionRX = regexp.MustCompile(`[0-9]+([._][0-9]+)*`)
+
+// DeviceFingerprint returns a coarse fingerprint of the device behind the
+// user agent. Version numbers are left out so that the fingerprint stays
+// the same when the browser or operating system updates.
+func DeviceFingerprint(userAgent string) string {
+	normalized := versionRX.ReplaceAllString(strings.ToLower(userAgent), "")
+	hash := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(hash[:8])
+}
+
+// Insert stores the login and sets whether it came from a new device. The
+// user's first login never counts as one, as there is nothing to compare it
+// with.
+func (m LoginModel) Insert(login *LoginEvent) error {
+	query := `
+		INSERT INTO login_events (user_id, ip_address, user_agent, fingerprint, session, new_device)
+		SELECT $1, $2, $3, $4, $5,
+		  EXISTS (SELECT 1 FROM login_events WHERE user_id = $1)
+		  AND (
+		    NOT EXISTS (SELECT 1 FROM login_events WHERE user_id = $1 AND fingerprint = $4)
+		    OR NOT EXISTS (SELECT 1 FROM login_events WHERE user_id = $1 AND ip_address = $2)
+		  )
+		RETURNING id, new_device, created_at`
+
+	args := []any{login.UserID, login.IPAddress, login.UserAgent, login.Fingerprint, login.Session}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&login.ID, &login.NewDevice, &login.CreatedAt)
+}
+
+// GetForUser returns one of the user's logins.
+func (m LoginModel) GetForUser(id uuid.UUID, userID uuid.UUID) (*LoginEvent, error) {
+	query := `
+		SELECT id, user_id, session, ip_address, user_agent, fingerprint, new_device, created_at
+		FROM login_events
+		WHERE id = $1 AND user_id = $2`
+
+	var login LoginEvent
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, id, userID).Scan(
+		&login.ID,
+		&login.UserID,
+		&login.Session,
+		&login.IPAddress,
+		&login.UserAgent,
+		&login.Fingerprint,
+		&login.NewDevice,
+		&login.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &login, nil
+}
+
+// GetAllForUser returns the user's logins, most recent first.
+func (m LoginModel) GetAllForUser(userID uuid.UUID, filters CursorFilters) ([]*LoginEvent, CursorMetadata, error) {
+	query := `
+		SELECT id, user_id, session, ip_address, user_agent, fingerprint, new_device, created_at
+		FROM login_events
+		WHERE user_id = $1
+		AND ($2::uuid IS NULL OR id < $2)
+		ORDER BY id DESC
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// One more login than asked for tells whether there is another page.
+	rows, err := m.DB.Query(ctx, query, userID, filters.Cursor, filters.PageSize+1)
+	if err != nil {
+		return nil, CursorMetadata{}, err
+	}
+	defer rows.Close()
+
+	logins := []*LoginEvent{}
+	for rows.Next() {
+		var login LoginEvent
+		err := rows.Scan(
+			&login.ID,
+			&login.UserID,
+			&login.Session,
+			&login.IPAddress,
+			&login.UserAgent,
+			&login.Fingerprint,
+			&login.NewDevice,
+			&login.CreatedAt,
+		)
+		if err != nil {
+			return nil, CursorMetadata{}, err
+		}
+		logins = append(logins, &login)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, CursorMetadata{}, err
+	}
+
+	metadata := CursorMetadata{PageSize: filters.PageSize}
+
+	if len(logins) > filters.PageSize {
+		logins = logins[:filters.PageSize]
+		metadata.NextCursor = &logins[len(logins)-1].ID
+	}
+
+	return logins, metadata, nil
+}
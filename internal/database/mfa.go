@@ -0,0 +1,201 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// MFAModel stores the TOTP secrets and recovery codes of users. Secrets are
+// stored encrypted; encrypting and decrypting them is up to the caller.
+type MFAModel struct {
+	DB    *pgxpool.Pool
+	Cache *Cache
+}
+
+// TOTP is the second factor enrollment of a user.
+type TOTP struct {
+	Secret   []byte
+	Enabled  bool
+	LastStep int64
+}
+
+// SetTOTPSecret starts a new, not yet enabled TOTP enrollment for the user.
+func (m MFAModel) SetTOTPSecret(userID uuid.UUID, secret []byte) error {
+	query := `
+		UPDATE users
+		SET totp_secret = $1, totp_enabled = false, totp_last_step = 0
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, secret, userID)
+
+	return err
+}
+
+func (m MFAModel) GetTOTP(userID uuid.UUID) (*TOTP, error) {
+	query := `
+		SELECT totp_secret, totp_enabled, totp_last_step
+		FROM users
+		WHERE id = $1 AND totp_secret IS NOT NULL`
+
+	var totp TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, userID).Scan(&totp.Secret, &totp.Enabled, &totp.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &totp, nil
+}
+
+// UseTOTPStep records the time step of an accepted code. It returns
+// ErrEditConflict if a code of the same or a later step was already used.
+func (m MFAModel) UseTOTPStep(userID uuid.UUID, step int64) error {
+	query := `
+		UPDATE users
+		SET totp_last_step = $1
+		WHERE id = $2 AND totp_last_step < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, step, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// EnableTOTP turns on two-factor authentication and replaces the user's
+// recovery codes with the given hashes.
+func (m MFAModel) EnableTOTP(userID uuid.UUID, recoveryCodeHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `UPDATE users SET totp_enabled = true WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryCodeHashes {
+		_, err = tx.Exec(ctx, `INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidateUser(userID)
+}
+
+// DisableTOTP removes the user's TOTP secret and recovery codes.
+func (m MFAModel) DisableTOTP(userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled = false, totp_last_step = 0
+		WHERE id = $1`
+
+	_, err = tx.Exec(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidateUser(userID)
+}
+
+// ConsumeRecoveryCode deletes the recovery code so it can't be used again.
+func (m MFAModel) ConsumeRecoveryCode(userID uuid.UUID, codePlaintext string) error {
+	query := `
+		DELETE FROM recovery_codes
+		WHERE user_id = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userID, hashTokenPlaintext(codePlaintext))
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GenerateRecoveryCodes returns n one-time recovery codes and their hashes.
+func GenerateRecoveryCodes(n int) ([]string, [][]byte, error) {
+	codes := make([]string, n)
+	hashes := make([][]byte, n)
+
+	for i := range n {
+		randomBytes := make([]byte, 10)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		codes[i] = base32.StdEncoding.EncodeToString(randomBytes)
+		hashes[i] = hashTokenPlaintext(codes[i])
+	}
+
+	return codes, hashes, nil
+}
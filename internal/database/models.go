@@ -11,15 +11,42 @@ var (
 )
 
 type Models struct {
-	Tokens      TokenModel
-	Users       UserModel
-	Permissions PermissionModel
+	Tokens        TokenModel
+	Users         UserModel
+	Permissions   PermissionModel
+	Denylist      DenylistModel
+	APIKeys       APIKeyModel
+	MFA           MFAModel
+	WebAuthn      WebAuthnModel
+	Identities    IdentityModel
+	OAuth         OAuthModel
+	Throttles     ThrottleModel
+	EmailChanges  EmailChangeModel
+	Roles         RoleModel
+	Organizations OrganizationModel
+	Invitations   InvitationModel
+	Audit         AuditModel
+	Logins        LoginModel
 }
 
-func NewModels(db *pgxpool.Pool) Models {
+// NewModels returns the models, caching lookups in cache unless it is nil.
+func NewModels(db *pgxpool.Pool, cache *Cache) Models {
 	return Models{
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Tokens:        TokenModel{DB: db, Cache: cache},
+		Users:         UserModel{DB: db, Cache: cache},
+		Permissions:   PermissionModel{DB: db, Cache: cache},
+		Denylist:      DenylistModel{DB: db, Cache: cache},
+		APIKeys:       APIKeyModel{DB: db},
+		MFA:           MFAModel{DB: db, Cache: cache},
+		WebAuthn:      WebAuthnModel{DB: db},
+		Identities:    IdentityModel{DB: db},
+		OAuth:         OAuthModel{DB: db},
+		Throttles:     ThrottleModel{DB: db},
+		EmailChanges:  EmailChangeModel{DB: db},
+		Roles:         RoleModel{DB: db, Cache: cache},
+		Organizations: OrganizationModel{DB: db},
+		Invitations:   InvitationModel{DB: db},
+		Audit:         AuditModel{DB: db},
+		Logins:        LoginModel{DB: db},
 	}
 }
@@ -0,0 +1,613 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+// Prefixes of the secrets handed out by the OAuth2 authorization server, so
+// they are easy to tell apart from each other and from API keys.
+const (
+	OAuthClientSecretPrefix = "grs_"
+	OAuthAccessTokenPrefix  = "gat_"
+	OAuthRefreshTokenPrefix = "gar_"
+)
+
+type OAuthTokenKind string
+
+const (
+	OAuthAccessToken  OAuthTokenKind = "access"
+	OAuthRefreshToken OAuthTokenKind = "refresh"
+)
+
+// OAuthClient is a third-party application registered by a user. Clients
+// without a secret are public clients, e.g. single-page or mobile apps.
+type OAuthClient struct {
+	ID           uuid.UUID   `json:"client_id"`
+	UserID       uuid.UUID   `json:"-"`
+	Name         string      `json:"name"`
+	Secret       string      `json:"client_secret,omitempty"`
+	SecretHash   []byte      `json:"-"`
+	Confidential bool        `json:"confidential"`
+	RedirectURIs []string    `json:"redirect_uris"`
+	Scopes       Permissions `json:"scopes"`
+	CreatedAt    time.Time   `json:"created_at"`
+}
+
+// OAuthCode is an authorization code waiting to be exchanged for tokens.
+type OAuthCode struct {
+	Plaintext     string
+	Hash          []byte
+	ClientID      uuid.UUID
+	UserID        uuid.UUID
+	RedirectURI   string
+	Scopes        Permissions
+	CodeChallenge string
+	Expiry        time.Time
+}
+
+// OAuthToken is an access or refresh token issued to a client. Tokens issued
+// from the same grant share a family, so refreshing or revoking one affects
+// the whole grant.
+type OAuthToken struct {
+	Plaintext string
+	Hash      []byte
+	Kind      OAuthTokenKind
+	ClientID  uuid.UUID
+	UserID    uuid.UUID
+	Scopes    Permissions
+	Family    uuid.UUID
+	Expiry    time.Time
+	CreatedAt time.Time
+}
+
+type OAuthModel struct {
+	DB *pgxpool.Pool
+}
+
+func generateSecret(prefix string) (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// GenerateSecret gives a confidential client a new secret.
+func (c *OAuthClient) GenerateSecret() error {
+	secret, err := generateSecret(OAuthClientSecretPrefix)
+	if err != nil {
+		return err
+	}
+
+	c.Secret = secret
+	c.SecretHash = hashTokenPlaintext(secret)
+	c.Confidential = true
+
+	return nil
+}
+
+func (c *OAuthClient) MatchesSecret(secret string) bool {
+	if !c.Confidential {
+		return false
+	}
+	return subtle.ConstantTimeCompare(c.SecretHash, hashTokenPlaintext(secret)) == 1
+}
+
+func (c *OAuthClient) HasRedirectURI(redirectURI string) bool {
+	return slices.Contains(c.RedirectURIs, redirectURI)
+}
+
+// ValidateOAuthClient checks the client against the permissions of the user
+// registering it; a client can never be granted more than its owner has.
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient, userPermissions Permissions) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(client.RedirectURIs) > 0 || client.Confidential, "redirect_uris", "must be provided for public clients")
+	v.Check(len(client.RedirectURIs) <= 10, "redirect_uris", "must not contain more than 10 entries")
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+	for _, redirectURI := range client.RedirectURIs {
+		u, err := url.Parse(redirectURI)
+		v.Check(err == nil && u.IsAbs() && u.Host != "" && u.Fragment == "", "redirect_uris", "must only contain absolute URLs without a fragment")
+	}
+
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+	for _, code := range client.Scopes {
+		v.Check(userPermissions.Includes(code), "scopes", "must only contain permissions you have")
+	}
+}
+
+func GenerateOAuthCode(clientID uuid.UUID, userID uuid.UUID, redirectURI string, scopes Permissions, codeChallenge string, ttl time.Duration) (*OAuthCode, error) {
+	plaintext, err := generateSecret("")
+	if err != nil {
+		return nil, err
+	}
+
+	code := &OAuthCode{
+		Plaintext:     plaintext,
+		Hash:          hashTokenPlaintext(plaintext),
+		ClientID:      clientID,
+		UserID:        userID,
+		RedirectURI:   redirectURI,
+		Scopes:        scopes,
+		CodeChallenge: codeChallenge,
+		Expiry:        time.Now().Add(ttl),
+	}
+
+	return code, nil
+}
+
+// MatchesVerifier checks a PKCE code verifier against the S256 challenge the
+// code was requested with.
+func (c *OAuthCode) MatchesVerifier(codeVerifier string) bool {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(c.CodeChallenge)) == 1
+}
+
+func GenerateOAuthToken(kind OAuthTokenKind, clientID uuid.UUID, userID uuid.UUID, scopes Permissions, family uuid.UUID, ttl time.Duration) (*OAuthToken, error) {
+	prefix := OAuthAccessTokenPrefix
+	if kind == OAuthRefreshToken {
+		prefix = OAuthRefreshTokenPrefix
+	}
+
+	plaintext, err := generateSecret(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &OAuthToken{
+		Plaintext: plaintext,
+		Hash:      hashTokenPlaintext(plaintext),
+		Kind:      kind,
+		ClientID:  clientID,
+		UserID:    userID,
+		Scopes:    scopes,
+		Family:    family,
+		Expiry:    time.Now().Add(ttl),
+		CreatedAt: time.Now(),
+	}
+
+	return token, nil
+}
+
+func (m OAuthModel) InsertClient(client *OAuthClient) error {
+	query := `
+		INSERT INTO oauth_clients (user_id, name, secret_hash, redirect_uris, scopes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []any{client.UserID, client.Name, client.SecretHash, client.RedirectURIs, []string(client.Scopes)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&client.ID, &client.CreatedAt)
+}
+
+func (m OAuthModel) GetClient(id uuid.UUID) (*OAuthClient, error) {
+	query := `
+		SELECT id, user_id, name, secret_hash, redirect_uris, scopes, created_at
+		FROM oauth_clients
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	client, err := scanOAuthClient(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+func (m OAuthModel) GetClientsForUser(userID uuid.UUID) ([]*OAuthClient, error) {
+	query := `
+		SELECT id, user_id, name, secret_hash, redirect_uris, scopes, created_at
+		FROM oauth_clients
+		WHERE user_id = $1
+		ORDER BY created_at DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+func scanOAuthClient(row pgx.Row) (*OAuthClient, error) {
+	var client OAuthClient
+	var scopes []string
+
+	err := row.Scan(
+		&client.ID,
+		&client.UserID,
+		&client.Name,
+		&client.SecretHash,
+		&client.RedirectURIs,
+		&scopes,
+		&client.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Confidential = client.SecretHash != nil
+	client.Scopes = scopes
+
+	return &client, nil
+}
+
+func (m OAuthModel) DeleteClientForUser(id uuid.UUID, userID uuid.UUID) error {
+	query := `
+		DELETE FROM oauth_clients
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m OAuthModel) InsertCode(code *OAuthCode) error {
+	query := `
+		INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	args := []any{code.Hash, code.ClientID, code.UserID, code.RedirectURI, []string(code.Scopes), code.CodeChallenge, code.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, args...)
+	return err
+}
+
+// ConsumeCode deletes an authorization code and returns it if it was issued
+// to the client and hasn't expired. Codes can only be exchanged once.
+func (m OAuthModel) ConsumeCode(clientID uuid.UUID, plaintext string) (*OAuthCode, error) {
+	query := `
+		DELETE FROM oauth_codes
+		WHERE hash = $1
+		RETURNING client_id, user_id, redirect_uri, scopes, code_challenge, expiry`
+
+	code := OAuthCode{
+		Plaintext: plaintext,
+		Hash:      hashTokenPlaintext(plaintext),
+	}
+	var scopes []string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, code.Hash).Scan(
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		&scopes,
+		&code.CodeChallenge,
+		&code.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if code.ClientID != clientID || time.Now().After(code.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	code.Scopes = scopes
+
+	return &code, nil
+}
+
+func (m OAuthModel) InsertToken(token *OAuthToken) error {
+	query := `
+		INSERT INTO oauth_tokens (hash, kind, client_id, user_id, scopes, family, expiry, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	args := []any{token.Hash, token.Kind, token.ClientID, token.UserID, []string(token.Scopes), token.Family, token.Expiry, token.CreatedAt}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, args...)
+	return err
+}
+
+// GetToken returns an active access or refresh token issued to the client.
+func (m OAuthModel) GetToken(clientID uuid.UUID, plaintext string) (*OAuthToken, error) {
+	query := `
+		SELECT kind, user_id, scopes, family, expiry, created_at
+		FROM oauth_tokens
+		WHERE hash = $1
+		AND client_id = $2
+		AND used = false
+		AND expiry > $3`
+
+	token := OAuthToken{
+		Plaintext: plaintext,
+		Hash:      hashTokenPlaintext(plaintext),
+		ClientID:  clientID,
+	}
+	var scopes []string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, token.Hash, clientID, time.Now()).Scan(
+		&token.Kind,
+		&token.UserID,
+		&scopes,
+		&token.Family,
+		&token.Expiry,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	token.Scopes = scopes
+
+	return &token, nil
+}
+
+// GetUserByAccessToken returns the user an unexpired access token was issued
+// for together with the token itself.
+func (m OAuthModel) GetUserByAccessToken(plaintext string) (*User, *OAuthToken, error) {
+	query := `
+		SELECT
+	    users.id,
+	    users.email,
+	    users.first_name,
+	    users.last_name,
+	    users.password_hash,
+	    users.created_at,
+	    users.last_updated,
+	    users.activated,
+	    users.totp_enabled,
+	    users.disabled_at,
+	    oauth_tokens.client_id,
+	    oauth_tokens.scopes,
+	    oauth_tokens.family,
+	    oauth_tokens.expiry,
+	    oauth_tokens.created_at
+		FROM users
+		INNER JOIN oauth_tokens
+		ON users.id = oauth_tokens.user_id
+		WHERE oauth_tokens.hash = $1
+		AND oauth_tokens.kind = $2
+		AND oauth_tokens.expiry > $3
+		AND users.activated
+		AND users.disabled_at IS NULL`
+
+	token := OAuthToken{
+		Plaintext: plaintext,
+		Hash:      hashTokenPlaintext(plaintext),
+		Kind:      OAuthAccessToken,
+	}
+
+	args := []any{token.Hash, token.Kind, time.Now()}
+
+	var user User
+	var scopes []string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password.hash,
+		&user.CreatedAt,
+		&user.LastUpdated,
+		&user.Activated,
+		&user.MFAEnabled,
+		&user.DisabledAt,
+		&token.ClientID,
+		&scopes,
+		&token.Family,
+		&token.Expiry,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	token.UserID = user.ID
+	token.Scopes = scopes
+
+	return &user, &token, nil
+}
+
+// ConsumeRefreshToken marks a refresh token issued to the client as used and
+// returns it. Presenting a used refresh token again revokes every token of
+// its grant and returns ErrTokenReused.
+func (m OAuthModel) ConsumeRefreshToken(clientID uuid.UUID, plaintext string) (*OAuthToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		SELECT user_id, scopes, family, expiry, created_at, used
+		FROM oauth_tokens
+		WHERE hash = $1
+		AND kind = $2
+		AND client_id = $3
+		AND expiry > $4
+		FOR UPDATE`
+
+	token := OAuthToken{
+		Plaintext: plaintext,
+		Hash:      hashTokenPlaintext(plaintext),
+		Kind:      OAuthRefreshToken,
+		ClientID:  clientID,
+	}
+	var scopes []string
+	var used bool
+
+	err = tx.QueryRow(ctx, query, token.Hash, token.Kind, clientID, time.Now()).Scan(
+		&token.UserID,
+		&scopes,
+		&token.Family,
+		&token.Expiry,
+		&token.CreatedAt,
+		&used,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	token.Scopes = scopes
+
+	if used {
+		query = `
+			DELETE FROM oauth_tokens
+			WHERE family = $1`
+
+		_, err = tx.Exec(ctx, query, token.Family)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &token, ErrTokenReused
+	}
+
+	query = `
+		UPDATE oauth_tokens
+		SET used = true
+		WHERE hash = $1`
+
+	_, err = tx.Exec(ctx, query, token.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// DeleteAllForUser revokes every grant the user gave to OAuth clients by
+// deleting their tokens and unredeemed authorization codes.
+func (m OAuthModel) DeleteAllForUser(userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `DELETE FROM oauth_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM oauth_tokens WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// RevokeToken deletes every token of the grant the given token belongs to,
+// as long as it was issued to the client. Unknown tokens are ignored.
+func (m OAuthModel) RevokeToken(clientID uuid.UUID, plaintext string) error {
+	query := `
+		DELETE FROM oauth_tokens
+		WHERE client_id = $1
+		AND family = (SELECT family FROM oauth_tokens WHERE hash = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, clientID, hashTokenPlaintext(plaintext))
+	return err
+}
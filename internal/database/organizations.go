@@ -0,0 +1,598 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+var (
+	ErrDuplicateSlug       = errors.New("duplicate slug")
+	ErrDuplicateMembership = errors.New("duplicate membership")
+)
+
+var slugRX = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// OrganizationRole is the role a member has within an organization. Every
+// role can do what the roles below it can.
+type OrganizationRole string
+
+const (
+	OrganizationRoleOwner  OrganizationRole = "owner"
+	OrganizationRoleAdmin  OrganizationRole = "admin"
+	OrganizationRoleMember OrganizationRole = "member"
+)
+
+var organizationRoleRanks = map[OrganizationRole]int{
+	OrganizationRoleMember: 1,
+	OrganizationRoleAdmin:  2,
+	OrganizationRoleOwner:  3,
+}
+
+// Includes reports whether the role grants at least what the other role
+// does.
+func (r OrganizationRole) Includes(other OrganizationRole) bool {
+	rank, ok := organizationRoleRanks[r]
+	return ok && rank >= organizationRoleRanks[other]
+}
+
+func ValidateOrganizationRole(v *validator.Validator, role OrganizationRole) {
+	_, ok := organizationRoleRanks[role]
+	v.Check(ok, "role", "must be owner, admin or member")
+}
+
+type Organization struct {
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	CreatedAt time.Time `json:"created_at"`
+	// Role is the role of the user the organization was looked up for.
+	Role OrganizationRole `json:"role,omitempty"`
+}
+
+type Membership struct {
+	OrganizationID uuid.UUID        `json:"organization_id"`
+	UserID         uuid.UUID        `json:"user_id"`
+	Email          string           `json:"email"`
+	FirstName      string           `json:"first_name"`
+	LastName       string           `json:"last_name"`
+	Role           OrganizationRole `json:"role"`
+	CreatedAt      time.Time        `json:"created_at"`
+}
+
+// OrganizationInvitation invites whoever owns the email address to join an
+// organization. Like tokens, only the hash of the plaintext is stored.
+type OrganizationInvitation struct {
+	ID             uuid.UUID        `json:"id"`
+	OrganizationID uuid.UUID        `json:"organization_id"`
+	Email          string           `json:"email"`
+	Role           OrganizationRole `json:"role"`
+	Plaintext      string           `json:"-"`
+	Hash           []byte           `json:"-"`
+	InvitedBy      *uuid.UUID       `json:"invited_by"`
+	Expiry         time.Time        `json:"expiry"`
+	CreatedAt      time.Time        `json:"created_at"`
+}
+
+type OrganizationModel struct {
+	DB *pgxpool.Pool
+}
+
+func ValidateOrganization(v *validator.Validator, organization *Organization) {
+	v.Check(organization.Name != "", "name", "must be provided")
+	v.Check(len(organization.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(organization.Slug != "", "slug", "must be provided")
+	v.Check(len(organization.Slug) <= 50, "slug", "must not be more than 50 bytes long")
+	v.Check(validator.Matches(organization.Slug, slugRX), "slug", "must only contain lowercase letters, digits and single dashes")
+}
+
+// GenerateOrganizationInvitation creates an invitation with a new
+// plaintext token that is valid for ttl.
+func GenerateOrganizationInvitation(organizationID uuid.UUID, email string, role OrganizationRole, invitedBy uuid.UUID, ttl time.Duration) (*OrganizationInvitation, error) {
+	plaintext, err := generateTokenPlaintext()
+	if err != nil {
+		return nil, err
+	}
+
+	invitation := &OrganizationInvitation{
+		OrganizationID: organizationID,
+		Email:          email,
+		Role:           role,
+		Plaintext:      plaintext,
+		InvitedBy:      &invitedBy,
+		Expiry:         time.Now().Add(ttl),
+	}
+
+	invitation.Hash = hashTokenPlaintext(invitation.Plaintext)
+
+	return invitation, nil
+}
+
+// Insert creates the organization with the user as its owner.
+func (m OrganizationModel) Insert(organization *Organization, ownerID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO organizations (name, slug)
+		VALUES ($1, $2)
+		RETURNING id, created_at`
+
+	err = tx.QueryRow(ctx, query, organization.Name, organization.Slug).Scan(&organization.ID, &organization.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == UniqueConstraint("organizations", "slug"):
+			return ErrDuplicateSlug
+		default:
+			return err
+		}
+	}
+
+	query = `
+		INSERT INTO organization_members (organization_id, user_id, role)
+		VALUES ($1, $2, $3)`
+
+	_, err = tx.Exec(ctx, query, organization.ID, ownerID, OrganizationRoleOwner)
+	if err != nil {
+		return err
+	}
+
+	organization.Role = OrganizationRoleOwner
+
+	return tx.Commit(ctx)
+}
+
+func (m OrganizationModel) Get(id uuid.UUID) (*Organization, error) {
+	query := `
+		SELECT id, name, slug, created_at
+		FROM organizations
+		WHERE id = $1`
+
+	var organization Organization
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(
+		&organization.ID,
+		&organization.Name,
+		&organization.Slug,
+		&organization.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &organization, nil
+}
+
+// GetAllForUser returns the organizations the user is a member of, along
+// with their role in each.
+func (m OrganizationModel) GetAllForUser(userID uuid.UUID) ([]*Organization, error) {
+	query := `
+		SELECT organizations.id, organizations.name, organizations.slug, organizations.created_at, organization_members.role
+		FROM organizations
+		INNER JOIN organization_members ON organization_members.organization_id = organizations.id
+		WHERE organization_members.user_id = $1
+		ORDER BY organizations.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	organizations := []*Organization{}
+	for rows.Next() {
+		var organization Organization
+		err := rows.Scan(
+			&organization.ID,
+			&organization.Name,
+			&organization.Slug,
+			&organization.CreatedAt,
+			&organization.Role,
+		)
+		if err != nil {
+			return nil, err
+		}
+		organizations = append(organizations, &organization)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return organizations, nil
+}
+
+func (m OrganizationModel) Update(organization *Organization) error {
+	query := `
+		UPDATE organizations
+		SET name = $1, slug = $2
+		WHERE id = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, organization.Name, organization.Slug, organization.ID)
+	if err != nil {
+		switch {
+		case err.Error() == UniqueConstraint("organizations", "slug"):
+			return ErrDuplicateSlug
+		default:
+			return err
+		}
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Delete deletes the organization together with its memberships and
+// invitations. Sessions acting in it are left without an active
+// organization.
+func (m OrganizationModel) Delete(id uuid.UUID) error {
+	query := `
+		DELETE FROM organizations
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m OrganizationModel) GetMembership(organizationID uuid.UUID, userID uuid.UUID) (*Membership, error) {
+	query := `
+		SELECT organization_members.organization_id, organization_members.user_id, users.email,
+		  users.first_name, users.last_name, organization_members.role, organization_members.created_at
+		FROM organization_members
+		INNER JOIN users ON users.id = organization_members.user_id
+		WHERE organization_members.organization_id = $1
+		AND organization_members.user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	membership, err := scanMembership(m.DB.QueryRow(ctx, query, organizationID, userID))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return membership, nil
+}
+
+func (m OrganizationModel) GetMembers(organizationID uuid.UUID) ([]*Membership, error) {
+	query := `
+		SELECT organization_members.organization_id, organization_members.user_id, users.email,
+		  users.first_name, users.last_name, organization_members.role, organization_members.created_at
+		FROM organization_members
+		INNER JOIN users ON users.id = organization_members.user_id
+		WHERE organization_members.organization_id = $1
+		ORDER BY organization_members.created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, organizationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []*Membership{}
+	for rows.Next() {
+		membership, err := scanMembership(rows)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, membership)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return memberships, nil
+}
+
+func scanMembership(row pgx.Row) (*Membership, error) {
+	var membership Membership
+
+	err := row.Scan(
+		&membership.OrganizationID,
+		&membership.UserID,
+		&membership.Email,
+		&membership.FirstName,
+		&membership.LastName,
+		&membership.Role,
+		&membership.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &membership, nil
+}
+
+func (m OrganizationModel) InsertMember(organizationID uuid.UUID, userID uuid.UUID, role OrganizationRole) error {
+	query := `
+		INSERT INTO organization_members (organization_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, organizationID, userID, role)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrDuplicateMembership
+	}
+
+	return nil
+}
+
+func (m OrganizationModel) UpdateMember(organizationID uuid.UUID, userID uuid.UUID, role OrganizationRole) error {
+	query := `
+		UPDATE organization_members
+		SET role = $1
+		WHERE organization_id = $2 AND user_id = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, role, organizationID, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m OrganizationModel) DeleteMember(organizationID uuid.UUID, userID uuid.UUID) error {
+	query := `
+		DELETE FROM organization_members
+		WHERE organization_id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, organizationID, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// CountOwners returns how many owners the organization has, so that the
+// last one can't be removed or demoted.
+func (m OrganizationModel) CountOwners(organizationID uuid.UUID) (int, error) {
+	query := `
+		SELECT count(*)
+		FROM organization_members
+		WHERE organization_id = $1 AND role = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var owners int
+	err := m.DB.QueryRow(ctx, query, organizationID, OrganizationRoleOwner).Scan(&owners)
+	return owners, err
+}
+
+// InsertInvitation stores the invitation, replacing any earlier invitation
+// of the same email address to the organization.
+func (m OrganizationModel) InsertInvitation(invitation *OrganizationInvitation) error {
+	query := `
+		INSERT INTO organization_invitations (organization_id, email, role, hash, invited_by, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (organization_id, email) DO UPDATE
+		SET role = EXCLUDED.role, hash = EXCLUDED.hash, invited_by = EXCLUDED.invited_by,
+		  expiry = EXCLUDED.expiry, created_at = NOW()
+		RETURNING id, created_at`
+
+	args := []any{
+		invitation.OrganizationID,
+		invitation.Email,
+		invitation.Role,
+		invitation.Hash,
+		invitation.InvitedBy,
+		invitation.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+// GetInvitation returns the unexpired invitation with the plaintext token.
+func (m OrganizationModel) GetInvitation(tokenPlaintext string) (*OrganizationInvitation, error) {
+	query := `
+		SELECT id, organization_id, email, role, hash, invited_by, expiry, created_at
+		FROM organization_invitations
+		WHERE hash = $1 AND expiry > $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	invitation, err := scanInvitation(m.DB.QueryRow(ctx, query, hashTokenPlaintext(tokenPlaintext), time.Now()))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	invitation.Plaintext = tokenPlaintext
+
+	return invitation, nil
+}
+
+// GetInvitations returns the organization's unexpired invitations.
+func (m OrganizationModel) GetInvitations(organizationID uuid.UUID) ([]*OrganizationInvitation, error) {
+	query := `
+		SELECT id, organization_id, email, role, hash, invited_by, expiry, created_at
+		FROM organization_invitations
+		WHERE organization_id = $1 AND expiry > $2
+		ORDER BY created_at DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, organizationID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []*OrganizationInvitation{}
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+func scanInvitation(row pgx.Row) (*OrganizationInvitation, error) {
+	var invitation OrganizationInvitation
+
+	err := row.Scan(
+		&invitation.ID,
+		&invitation.OrganizationID,
+		&invitation.Email,
+		&invitation.Role,
+		&invitation.Hash,
+		&invitation.InvitedBy,
+		&invitation.Expiry,
+		&invitation.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &invitation, nil
+}
+
+func (m OrganizationModel) DeleteInvitation(organizationID uuid.UUID, id uuid.UUID) error {
+	query := `
+		DELETE FROM organization_invitations
+		WHERE organization_id = $1 AND id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, organizationID, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// AcceptInvitation makes the user a member with the invitation's role and
+// deletes the invitation.
+func (m OrganizationModel) AcceptInvitation(invitation *OrganizationInvitation, userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		DELETE FROM organization_invitations
+		WHERE id = $1`
+
+	result, err := tx.Exec(ctx, query, invitation.ID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	query = `
+		INSERT INTO organization_members (organization_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`
+
+	result, err = tx.Exec(ctx, query, invitation.OrganizationID, userID, invitation.Role)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrDuplicateMembership
+	}
+
+	return tx.Commit(ctx)
+}
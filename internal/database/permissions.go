@@ -2,18 +2,41 @@ package database
 
 import (
 	"context"
-	"slices"
+	"errors"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/lieberdev/go-rest-template/internal/validator"
 )
 
+var (
+	ErrDuplicatePermission = errors.New("duplicate permission")
+	ErrProtectedPermission = errors.New("protected permission")
+)
+
+var permissionCodeRX = regexp.MustCompile(`^[a-z0-9_-]+([.:][a-z0-9_-]+)*([.:]\*)?$`)
+
+// PermissionAdmin is the permission that implies every other one.
+const PermissionAdmin = "admin"
+
+// Permissions is a set of granted permission codes. Codes are segments
+// separated by '.' or ':', and a code ending in a '*' segment, such as
+// "users:*" or "reports.finance.*", grants every code below it.
 type Permissions []string
 
+type Permission struct {
+	ID          uuid.UUID `json:"id"`
+	Code        string    `json:"code"`
+	Description string    `json:"description"`
+}
+
 type PermissionModel struct {
-	DB *pgxpool.Pool
+	DB    *pgxpool.Pool
+	Cache *Cache
 }
 
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
@@ -21,8 +44,32 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
 }
 
+// Includes reports whether any of the permissions grants the code. The
+// code may itself end in a wildcard, in which case it is only granted by
+// the same or a broader wildcard.
 func (p Permissions) Includes(code string) bool {
-	return slices.Contains(p, code)
+	for _, granted := range p {
+		if grants(granted, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// grants reports whether the granted permission covers the code. A wildcard
+// matches one or more whole segments, so "users:*" grants "users:read" and
+// "users:read.own" but neither "users" nor "users-archive:read".
+func grants(granted string, code string) bool {
+	if granted == code || granted == PermissionAdmin {
+		return true
+	}
+
+	prefix, ok := strings.CutSuffix(granted, "*")
+	if !ok || prefix == "" {
+		return false
+	}
+
+	return len(code) > len(prefix) && strings.HasPrefix(code, prefix)
 }
 
 func (m PermissionModel) InsertForUser(userID uuid.UUID, codes ...string) error {
@@ -30,23 +77,40 @@ func (m PermissionModel) InsertForUser(userID uuid.UUID, codes ...string) error
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id
 	  FROM permissions
-	  WHERE permissions.code = ANY($2)`
+	  WHERE permissions.code = ANY($2)
+	  ON CONFLICT DO NOTHING`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.Exec(ctx, query, userID, codes)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return m.Cache.invalidatePermissions(userID)
 }
 
+// GetAllForUser returns the permissions granted to the user directly and
+// through any of their roles.
 func (m PermissionModel) GetAllForUser(userID uuid.UUID) (Permissions, error) {
+	return m.Cache.getPermissions(userID, func() (Permissions, error) {
+		return m.getAllForUser(userID)
+	})
+}
+
+func (m PermissionModel) getAllForUser(userID uuid.UUID) (Permissions, error) {
 	query := `
 		SELECT permissions.code
 		FROM permissions
 		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-		INNER JOIN users ON users_permissions.user_id = users.id
-		WHERE users.id = $1`
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+		INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+		WHERE users_roles.user_id = $1`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -73,3 +137,288 @@ func (m PermissionModel) GetAllForUser(userID uuid.UUID) (Permissions, error) {
 
 	return permissions, nil
 }
+
+func ValidatePermissionCode(v *validator.Validator, key string, code string) {
+	v.Check(code != "", key, "must be provided")
+	v.Check(len(code) <= 100, key, "must not be more than 100 bytes long")
+	v.Check(validator.Matches(code, permissionCodeRX), key, "must only contain lowercase letters, digits, '_' and '-', separated by '.' or ':', optionally ending in a '*' segment")
+}
+
+func ValidatePermission(v *validator.Validator, permission *Permission) {
+	ValidatePermissionCode(v, "code", permission.Code)
+	v.Check(len(permission.Description) <= 500, "description", "must not be more than 500 bytes long")
+}
+
+func (m PermissionModel) Insert(permission *Permission) error {
+	query := `
+		INSERT INTO permissions (code, description)
+		VALUES ($1, $2)
+		RETURNING id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, permission.Code, permission.Description).Scan(&permission.ID)
+	if err != nil {
+		switch {
+		case err.Error() == UniqueConstraint("permissions", "code"):
+			return ErrDuplicatePermission
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m PermissionModel) Get(id uuid.UUID) (*Permission, error) {
+	query := `
+		SELECT id, code, description
+		FROM permissions
+		WHERE id = $1`
+
+	var permission Permission
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(&permission.ID, &permission.Code, &permission.Description)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &permission, nil
+}
+
+func (m PermissionModel) GetAll() ([]*Permission, error) {
+	query := `
+		SELECT id, code, description
+		FROM permissions
+		ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []*Permission{}
+	for rows.Next() {
+		var permission Permission
+		err := rows.Scan(&permission.ID, &permission.Code, &permission.Description)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, &permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// Codes returns the codes of every permission that exists.
+func (m PermissionModel) Codes() (Permissions, error) {
+	permissions, err := m.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	codes := Permissions{}
+	for _, permission := range permissions {
+		codes = append(codes, permission.Code)
+	}
+
+	return codes, nil
+}
+
+// Update changes a permission's code and description. A new code replaces
+// the old one in the permissions of API keys and invitations and the scopes
+// of OAuth clients and tokens too. The code of PermissionAdmin can't be
+// changed.
+func (m PermissionModel) Update(permission *Permission) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var oldCode string
+
+	err = tx.QueryRow(ctx, `SELECT code FROM permissions WHERE id = $1 FOR UPDATE`, permission.ID).Scan(&oldCode)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	if oldCode == PermissionAdmin && permission.Code != PermissionAdmin {
+		return ErrProtectedPermission
+	}
+
+	query := `
+		UPDATE permissions
+		SET code = $1, description = $2
+		WHERE id = $3`
+
+	_, err = tx.Exec(ctx, query, permission.Code, permission.Description, permission.ID)
+	if err != nil {
+		switch {
+		case err.Error() == UniqueConstraint("permissions", "code"):
+			return ErrDuplicatePermission
+		default:
+			return err
+		}
+	}
+
+	if oldCode != permission.Code {
+		for _, query := range []string{
+			`UPDATE api_keys SET permissions = array_replace(permissions, $1, $2) WHERE $1 = ANY(permissions)`,
+			`UPDATE invitations SET permissions = array_replace(permissions, $1, $2) WHERE $1 = ANY(permissions)`,
+			`UPDATE oauth_clients SET scopes = array_replace(scopes, $1, $2) WHERE $1 = ANY(scopes)`,
+			`UPDATE oauth_codes SET scopes = array_replace(scopes, $1, $2) WHERE $1 = ANY(scopes)`,
+			`UPDATE oauth_tokens SET scopes = array_replace(scopes, $1, $2) WHERE $1 = ANY(scopes)`,
+		} {
+			_, err = tx.Exec(ctx, query, oldCode, permission.Code)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidateAll()
+}
+
+// Delete deletes a permission and removes its code from the permissions of
+// API keys and invitations and the scopes of OAuth clients and tokens.
+// PermissionAdmin can't be deleted.
+func (m PermissionModel) Delete(id uuid.UUID) error {
+	query := `
+		DELETE FROM permissions
+		WHERE id = $1
+		RETURNING code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var code string
+
+	err = tx.QueryRow(ctx, query, id).Scan(&code)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	if code == PermissionAdmin {
+		return ErrProtectedPermission
+	}
+
+	for _, query := range []string{
+		`UPDATE api_keys SET permissions = array_remove(permissions, $1) WHERE $1 = ANY(permissions)`,
+		`UPDATE invitations SET permissions = array_remove(permissions, $1) WHERE $1 = ANY(permissions)`,
+		`UPDATE oauth_clients SET scopes = array_remove(scopes, $1) WHERE $1 = ANY(scopes)`,
+		`UPDATE oauth_codes SET scopes = array_remove(scopes, $1) WHERE $1 = ANY(scopes)`,
+		`UPDATE oauth_tokens SET scopes = array_remove(scopes, $1) WHERE $1 = ANY(scopes)`,
+	} {
+		_, err = tx.Exec(ctx, query, code)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidateAll()
+}
+
+// GetDirectForUser returns only the permissions granted to the user
+// directly, leaving out those that come from roles.
+func (m PermissionModel) GetDirectForUser(userID uuid.UUID) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1
+		ORDER BY permissions.code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+func (m PermissionModel) DeleteForUser(userID uuid.UUID, code string) error {
+	query := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+		AND users_permissions.user_id = $1
+		AND permissions.code = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userID, code)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return m.Cache.invalidatePermissions(userID)
+}
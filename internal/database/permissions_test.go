@@ -0,0 +1,89 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+func TestPermissionsIncludes(t *testing.T) {
+	tests := []struct {
+		name    string
+		granted Permissions
+		code    string
+		want    bool
+	}{
+		{"exact code", Permissions{"users:read"}, "users:read", true},
+		{"other code", Permissions{"users:read"}, "users:write", false},
+		{"no permissions", Permissions{}, "users:read", false},
+		{"one of several", Permissions{"movies:read", "users:read"}, "users:read", true},
+
+		{"admin grants a code", Permissions{PermissionAdmin}, "users:read", true},
+		{"admin grants a nested code", Permissions{PermissionAdmin}, "reports.finance.q1", true},
+		{"admin grants a wildcard", Permissions{PermissionAdmin}, "users:*", true},
+		{"admin grants admin", Permissions{PermissionAdmin}, PermissionAdmin, true},
+		{"wildcard doesn't grant admin", Permissions{"users:*"}, PermissionAdmin, false},
+		{"admin isn't a prefix", Permissions{"admin:*"}, PermissionAdmin, false},
+
+		{"wildcard grants a child", Permissions{"users:*"}, "users:read", true},
+		{"wildcard grants a grandchild", Permissions{"users:*"}, "users:read.own", true},
+		{"wildcard doesn't grant its parent", Permissions{"users:*"}, "users", false},
+		{"wildcard doesn't grant an empty segment", Permissions{"users:*"}, "users:", false},
+		{"wildcard doesn't grant a longer name", Permissions{"users:*"}, "users-archive:read", false},
+		{"wildcard doesn't grant another name", Permissions{"users:*"}, "movies:read", false},
+		{"dotted wildcard", Permissions{"reports.finance.*"}, "reports.finance.q1", true},
+		{"dotted wildcard and a sibling", Permissions{"reports.finance.*"}, "reports.hr.q1", false},
+
+		{"wildcard grants the same wildcard", Permissions{"users:*"}, "users:*", true},
+		{"wildcard grants a narrower wildcard", Permissions{"users:*"}, "users:read.*", true},
+		{"wildcard doesn't grant a broader wildcard", Permissions{"users:read.*"}, "users:*", false},
+		{"code doesn't grant a wildcard", Permissions{"users:read"}, "users:*", false},
+		{"code doesn't grant the wildcard below it", Permissions{"users"}, "users:*", false},
+
+		{"bare wildcard grants nothing", Permissions{"*"}, "users:read", false},
+		{"bare wildcard doesn't grant admin", Permissions{"*"}, PermissionAdmin, false},
+		{"code doesn't grant a bare wildcard", Permissions{"users:read"}, "*", false},
+		{"wildcard doesn't grant a bare wildcard", Permissions{"users:*"}, "*", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.granted.Includes(tt.code)
+			if got != tt.want {
+				t.Errorf("%q includes %q: got %t; want %t", tt.granted, tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePermissionCode(t *testing.T) {
+	tests := []struct {
+		code  string
+		valid bool
+	}{
+		{"admin", true},
+		{"users:read", true},
+		{"users:read.own", true},
+		{"users:*", true},
+		{"reports.finance.*", true},
+		{"users-archive:read_all", true},
+		{"", false},
+		{"*", false},
+		{"users*", false},
+		{"*:read", false},
+		{"users:*.read", false},
+		{"users:", false},
+		{"Users:read", false},
+		{"users read", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			v := validator.New()
+			ValidatePermissionCode(v, "code", tt.code)
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %t; want %t (errors: %v)", v.Valid(), tt.valid, v.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+var (
+	ErrDuplicateRole = errors.New("duplicate role")
+)
+
+// Role is a named bundle of permissions. Users holding a role have all of
+// its permissions on top of those granted to them directly.
+type Role struct {
+	ID          uuid.UUID   `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+type RoleModel struct {
+	DB    *pgxpool.Pool
+	Cache *Cache
+}
+
+// ValidateRole checks the role against the codes of all existing
+// permissions. Roles can only hold permissions that exist as such, so a
+// role can't be given "users:read" just because "users:*" exists.
+func ValidateRole(v *validator.Validator, role *Role, permissions Permissions) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(role.Description) <= 500, "description", "must not be more than 500 bytes long")
+
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range role.Permissions {
+		v.Check(slices.Contains(permissions, code), "permissions", "must only contain existing permissions")
+	}
+}
+
+func (m RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO roles (name, description)
+		VALUES ($1, $2)
+		RETURNING id, created_at`
+
+	err = tx.QueryRow(ctx, query, role.Name, role.Description).Scan(&role.ID, &role.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == UniqueConstraint("roles", "name"):
+			return ErrDuplicateRole
+		default:
+			return err
+		}
+	}
+
+	err = setRolePermissions(ctx, tx, role)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (m RoleModel) Get(id uuid.UUID) (*Role, error) {
+	query := `
+		SELECT roles.id, roles.name, roles.description, roles.created_at,
+		  COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM roles
+		LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+		WHERE roles.id = $1
+		GROUP BY roles.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	role, err := scanRole(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return role, nil
+}
+
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+		SELECT roles.id, roles.name, roles.description, roles.created_at,
+		  COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM roles
+		LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+		GROUP BY roles.id
+		ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.queryRoles(ctx, query)
+}
+
+// GetAllForUser returns the roles the user holds.
+func (m RoleModel) GetAllForUser(userID uuid.UUID) ([]*Role, error) {
+	query := `
+		SELECT roles.id, roles.name, roles.description, roles.created_at,
+		  COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM roles
+		INNER JOIN users_roles ON users_roles.role_id = roles.id
+		LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+		WHERE users_roles.user_id = $1
+		GROUP BY roles.id
+		ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.queryRoles(ctx, query, userID)
+}
+
+func (m RoleModel) queryRoles(ctx context.Context, query string, args ...any) ([]*Role, error) {
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func scanRole(row pgx.Row) (*Role, error) {
+	var role Role
+	var permissions []string
+
+	err := row.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	role.Permissions = permissions
+
+	return &role, nil
+}
+
+// Update stores the role's name and description and replaces its
+// permissions.
+func (m RoleModel) Update(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE roles
+		SET name = $1, description = $2
+		WHERE id = $3`
+
+	result, err := tx.Exec(ctx, query, role.Name, role.Description, role.ID)
+	if err != nil {
+		switch {
+		case err.Error() == UniqueConstraint("roles", "name"):
+			return ErrDuplicateRole
+		default:
+			return err
+		}
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	query = `
+		DELETE FROM roles_permissions
+		WHERE role_id = $1`
+
+	_, err = tx.Exec(ctx, query, role.ID)
+	if err != nil {
+		return err
+	}
+
+	err = setRolePermissions(ctx, tx, role)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidateAll()
+}
+
+func setRolePermissions(ctx context.Context, tx pgx.Tx, role *Role) error {
+	query := `
+		INSERT INTO roles_permissions
+		SELECT $1, permissions.id
+		FROM permissions
+		WHERE permissions.code = ANY($2)`
+
+	_, err := tx.Exec(ctx, query, role.ID, []string(role.Permissions))
+	return err
+}
+
+func (m RoleModel) Delete(id uuid.UUID) error {
+	query := `
+		DELETE FROM roles
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return m.Cache.invalidateAll()
+}
+
+// InsertForUser gives the user the named roles. Names of roles that don't
+// exist are ignored, as are roles the user already holds.
+func (m RoleModel) InsertForUser(userID uuid.UUID, names ...string) error {
+	query := `
+		INSERT INTO users_roles
+		SELECT $1, roles.id
+		FROM roles
+		WHERE roles.name = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID, names)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidatePermissions(userID)
+}
+
+func (m RoleModel) DeleteForUser(userID uuid.UUID, name string) error {
+	query := `
+		DELETE FROM users_roles
+		USING roles
+		WHERE users_roles.role_id = roles.id
+		AND users_roles.user_id = $1
+		AND roles.name = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userID, name)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return m.Cache.invalidatePermissions(userID)
+}
+
+// Names returns the names of every role that exists.
+func (m RoleModel) Names() ([]string, error) {
+	roles, err := m.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, role := range roles {
+		names = append(names, role.Name)
+	}
+
+	return names, nil
+}
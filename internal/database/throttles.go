@@ -0,0 +1,229 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Throttle tracks failed logins for a key, either an account or a client IP
+// address. Once a key collects too many failures it is locked, for twice as
+// long as the previous time on every further lockout.
+type Throttle struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	Lockouts      int        `json:"lockouts"`
+	LockedUntil   *time.Time `json:"locked_until"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+}
+
+// ThrottlePolicy decides when a key gets locked and for how long. Failures
+// further apart than Window don't add up.
+type ThrottlePolicy struct {
+	Threshold   int
+	Duration    time.Duration
+	MaxDuration time.Duration
+	Window      time.Duration
+}
+
+type ThrottleModel struct {
+	DB *pgxpool.Pool
+}
+
+func UserThrottleKey(userID uuid.UUID) string {
+	return "user:" + userID.String()
+}
+
+func IPThrottleKey(ipAddress string) string {
+	return "ip:" + ipAddress
+}
+
+// Locked reports whether the throttle is locked at the given time.
+func (t *Throttle) Locked(now time.Time) bool {
+	return t.LockedUntil != nil && t.LockedUntil.After(now)
+}
+
+// LockedUntil returns the latest time any of the keys is locked until, or
+// the zero time if none of them is locked.
+func (m ThrottleModel) LockedUntil(keys ...string) (time.Time, error) {
+	query := `
+		SELECT MAX(locked_until)
+		FROM login_throttles
+		WHERE key = ANY($1)
+		AND locked_until > $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var lockedUntil *time.Time
+	err := m.DB.QueryRow(ctx, query, keys, time.Now()).Scan(&lockedUntil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if lockedUntil == nil {
+		return time.Time{}, nil
+	}
+
+	return *lockedUntil, nil
+}
+
+// RecordFailure counts a failed login for the key and locks it once it
+// reaches the policy's threshold. The returned throttle reports whether the
+// key is locked now.
+func (m ThrottleModel) RecordFailure(key string, policy ThrottlePolicy) (*Throttle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+
+	query := `
+		INSERT INTO login_throttles (key, last_failure_at)
+		VALUES ($1, $2)
+		ON CONFLICT (key) DO NOTHING`
+
+	_, err = tx.Exec(ctx, query, key, now)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT key, failures, lockouts, locked_until, last_failure_at
+		FROM login_throttles
+		WHERE key = $1
+		FOR UPDATE`
+
+	var throttle Throttle
+	err = tx.QueryRow(ctx, query, key).Scan(
+		&throttle.Key,
+		&throttle.Failures,
+		&throttle.Lockouts,
+		&throttle.LockedUntil,
+		&throttle.LastFailureAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if now.Sub(throttle.LastFailureAt) > policy.Window {
+		throttle.Failures = 0
+	}
+
+	throttle.Failures++
+	throttle.LastFailureAt = now
+
+	if throttle.Failures >= policy.Threshold {
+		duration := policy.Duration << min(throttle.Lockouts, 30)
+		if duration <= 0 || duration > policy.MaxDuration {
+			duration = policy.MaxDuration
+		}
+
+		lockedUntil := now.Add(duration)
+		throttle.LockedUntil = &lockedUntil
+		throttle.Lockouts++
+		throttle.Failures = 0
+	}
+
+	query = `
+		UPDATE login_throttles
+		SET failures = $2, lockouts = $3, locked_until = $4, last_failure_at = $5
+		WHERE key = $1`
+
+	args := []any{throttle.Key, throttle.Failures, throttle.Lockouts, throttle.LockedUntil, throttle.LastFailureAt}
+
+	_, err = tx.Exec(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttle, nil
+}
+
+// GetAllLocked returns every throttle that is currently locked.
+func (m ThrottleModel) GetAllLocked() ([]*Throttle, error) {
+	query := `
+		SELECT key, failures, lockouts, locked_until, last_failure_at
+		FROM login_throttles
+		WHERE locked_until > $1
+		ORDER BY locked_until DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	throttles := []*Throttle{}
+	for rows.Next() {
+		var throttle Throttle
+		err := rows.Scan(
+			&throttle.Key,
+			&throttle.Failures,
+			&throttle.Lockouts,
+			&throttle.LockedUntil,
+			&throttle.LastFailureAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		throttles = append(throttles, &throttle)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return throttles, nil
+}
+
+// Delete clears the failures and any lock of the key.
+func (m ThrottleModel) Delete(key string) error {
+	query := `
+		DELETE FROM login_throttles
+		WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, key)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteExpired removes throttles that aren't locked and haven't seen a
+// failure since the given time.
+func (m ThrottleModel) DeleteExpired(before time.Time) error {
+	query := `
+		DELETE FROM login_throttles
+		WHERE last_failure_at < $1
+		AND (locked_until IS NULL OR locked_until < $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, before, time.Now())
+	return err
+}
@@ -5,10 +5,17 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+var (
+	ErrTokenReused = errors.New("token reused")
 )
 
 type Scope string
@@ -16,6 +23,15 @@ const (
 	ScopeActivation	Scope = "activation"
 	ScopeAuthentication Scope = "authentication"
 	ScopePasswordReset Scope = "password-reset"
+	ScopeRefresh Scope = "refresh"
+	ScopeMFAPending Scope = "mfa-pending"
+	ScopeWebAuthnRegistration Scope = "webauthn-registration"
+	ScopeWebAuthnLogin Scope = "webauthn-login"
+	ScopeMagicLink Scope = "magic-link"
+	ScopeUnlock Scope = "unlock"
+	ScopeEmailChange Scope = "email-change"
+	ScopeEmailChangeCancel Scope = "email-change-cancel"
+	ScopeLoginAlert Scope = "login-alert"
 )
 
 type Token struct {
@@ -24,40 +40,120 @@ type Token struct {
 	UserID    uuid.UUID `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     Scope     `json:"-"`
+	Family      uuid.UUID `json:"-"`
+	CreatedAt   time.Time `json:"-"`
+	LastUsedAt  time.Time `json:"-"`
+	UserAgent   string    `json:"-"`
+	IPAddress   string    `json:"-"`
+	DeviceLabel string    `json:"-"`
+	// OrganizationID is the organization the session acts in, if any.
+	OrganizationID *uuid.UUID `json:"-"`
+	// ImpersonatorID is the admin acting as the user with this token.
+	ImpersonatorID *uuid.UUID `json:"impersonator_id,omitempty"`
+}
+
+// Session describes a token family: everything issued from one login,
+// including the tokens created by rotating its refresh token.
+type Session struct {
+	ID          uuid.UUID `json:"id"`
+	DeviceLabel string    `json:"device_label"`
+	UserAgent   string    `json:"user_agent"`
+	IPAddress   string    `json:"ip_address"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	Current     bool      `json:"current"`
 }
 
 type TokenModel struct {
-	DB *pgxpool.Pool
+	DB    *pgxpool.Pool
+	Cache *Cache
 }
 
+// GenerateToken creates a token in a new token family. Tokens that are handed
+// out together, like an authentication and refresh token pair, should share
+// the family of the first token so they can be revoked as a whole.
 func GenerateToken(userID uuid.UUID, ttl time.Duration, scope Scope) (*Token, error) {
+	family, err := uuid.NewV7()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
 	token := &Token{
-		UserID: userID,
-		Expiry: time.Now().Add(ttl),
-		Scope:  scope,
+		UserID:     userID,
+		Expiry:     now.Add(ttl),
+		Scope:      scope,
+		Family:     family,
+		CreatedAt:  now,
+		LastUsedAt: now,
 	}
 
 	randomBytes := make([]byte, 16)
 
-	_, err := rand.Read(randomBytes)
+	_, err = rand.Read(randomBytes)
 	if err != nil {
 		return nil, err
 	}
 
 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	token.Hash = hashTokenPlaintext(token.Plaintext)
 
 	return token, nil
 }
 
+// generateTokenPlaintext returns a random plaintext in the same format as
+// the plaintext of tokens, for things that are stored like tokens but don't
+// belong to a user yet, such as invitations.
+func generateTokenPlaintext() (string, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+func hashTokenPlaintext(tokenPlaintext string) []byte {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return hash[:]
+}
+
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)`
+		INSERT INTO tokens (
+	    hash,
+	    user_id,
+	    expiry,
+	    scope,
+	    family,
+	    created_at,
+	    last_used_at,
+	    user_agent,
+	    ip_address,
+	    device_label,
+	    organization_id,
+	    impersonator_id
+	  )
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
 
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []any{
+		token.Hash,
+		token.UserID,
+		token.Expiry,
+		token.Scope,
+		token.Family,
+		token.CreatedAt,
+		token.LastUsedAt,
+		token.UserAgent,
+		token.IPAddress,
+		token.DeviceLabel,
+		token.OrganizationID,
+		token.ImpersonatorID,
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -76,6 +172,245 @@ func (m TokenModel) DeleteAllForUser(scope Scope, userID uuid.UUID) error {
 	defer cancel()
 
 	_, err := m.DB.Exec(ctx, query, scope, userID)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidateUser(userID)
+}
+
+// DeleteFamilyForUser deletes every token in the family, e.g. an
+// authentication token together with the refresh token handed out with it.
+func (m TokenModel) DeleteFamilyForUser(userID uuid.UUID, family uuid.UUID) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND family = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userID, family)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return m.Cache.invalidateUser(userID)
+}
+
+// DeleteAllSessionsForUser deletes every authentication and refresh token
+// the user holds, logging them out on all devices.
+func (m TokenModel) DeleteAllSessionsForUser(userID uuid.UUID) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = ANY($1) AND user_id = $2`
+
+	scopes := []string{string(ScopeAuthentication), string(ScopeRefresh)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, scopes, userID)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidateUser(userID)
+}
+
+// Get returns the unexpired token without consuming it, whether or not it
+// has been used.
+func (m TokenModel) Get(scope Scope, tokenPlaintext string) (*Token, error) {
+	query := `
+		SELECT user_id, expiry, family, device_label, organization_id
+		FROM tokens
+		WHERE hash = $1
+		AND scope = $2
+		AND expiry > $3`
+
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      hashTokenPlaintext(tokenPlaintext),
+		Scope:     scope,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, token.Hash, scope, time.Now()).Scan(
+		&token.UserID,
+		&token.Expiry,
+		&token.Family,
+		&token.DeviceLabel,
+		&token.OrganizationID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// Consume marks a single-use token as spent and returns it. Spent tokens are
+// kept until they expire so that a replayed token can be detected, in which
+// case every token in its family is deleted and ErrTokenReused is returned
+// together with the token, so the caller knows which family was revoked.
+func (m TokenModel) Consume(scope Scope, tokenPlaintext string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		SELECT user_id, expiry, family, device_label, organization_id, used
+		FROM tokens
+		WHERE hash = $1
+		AND scope = $2
+		AND expiry > $3
+		FOR UPDATE`
+
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      hashTokenPlaintext(tokenPlaintext),
+		Scope:     scope,
+	}
+	var used bool
+
+	err = tx.QueryRow(ctx, query, token.Hash, scope, time.Now()).Scan(
+		&token.UserID,
+		&token.Expiry,
+		&token.Family,
+		&token.DeviceLabel,
+		&token.OrganizationID,
+		&used,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if used {
+		query = `
+			DELETE FROM tokens
+			WHERE user_id = $1 AND family = $2`
+
+		_, err = tx.Exec(ctx, query, token.UserID, token.Family)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		err = m.Cache.invalidateUser(token.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return &token, ErrTokenReused
+	}
+
+	query = `
+		UPDATE tokens
+		SET used = true
+		WHERE hash = $1`
+
+	_, err = tx.Exec(ctx, query, token.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// GetSessionsForUser returns the user's active sessions, most recently used
+// first. Every live session has exactly one unused refresh token.
+func (m TokenModel) GetSessionsForUser(userID uuid.UUID) ([]*Session, error) {
+	query := `
+		SELECT
+	    family,
+	    device_label,
+	    user_agent,
+	    ip_address,
+	    (SELECT MIN(created_at) FROM tokens AS t WHERE t.family = tokens.family),
+	    last_used_at
+		FROM tokens
+		WHERE user_id = $1
+		AND scope = $2
+		AND NOT used
+		AND expiry > $3
+		ORDER BY last_used_at DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, userID, ScopeRefresh, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.DeviceLabel,
+			&session.UserAgent,
+			&session.IPAddress,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// UpdateLastUsed records when and from where a token family was last used.
+func (m TokenModel) UpdateLastUsed(family uuid.UUID, lastUsedAt time.Time, userAgent string, ipAddress string) error {
+	query := `
+		UPDATE tokens
+		SET last_used_at = $1, user_agent = $2, ip_address = $3
+		WHERE family = $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, lastUsedAt, userAgent, ipAddress, family)
 
 	return err
 }
+
+func ValidateDeviceLabel(v *validator.Validator, deviceLabel string) {
+	v.Check(len(deviceLabel) <= 100, "device_label", "must not be more than 100 bytes long")
+}
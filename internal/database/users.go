@@ -2,8 +2,8 @@ package database
 
 import (
 	"context"
-	"crypto/sha256"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,14 +19,16 @@ var (
 )
 
 type User struct {
-	ID          uuid.UUID `json:"id"`
-	Email       string    `json:"email"`
-	FirstName   string    `json:"first_name"`
-	LastName    string    `json:"last_name"`
-	Password    password  `json:"-"`
-	CreatedAt   time.Time `json:"created_at"`
-	LastUpdated time.Time `json:"last_updated"`
-	Activated   bool      `json:"activated"`
+	ID          uuid.UUID  `json:"id"`
+	Email       string     `json:"email"`
+	FirstName   string     `json:"first_name"`
+	LastName    string     `json:"last_name"`
+	Password    password   `json:"-"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUpdated time.Time  `json:"last_updated"`
+	Activated   bool       `json:"activated"`
+	MFAEnabled  bool       `json:"mfa_enabled"`
+	DisabledAt  *time.Time `json:"disabled_at"`
 }
 
 type password struct {
@@ -35,13 +37,20 @@ type password struct {
 }
 
 type UserModel struct {
-	DB *pgxpool.Pool
+	DB    *pgxpool.Pool
+	Cache *Cache
 }
 
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// Disabled reports whether an admin has disabled the user. Unlike an
+// unactivated user, a disabled one can't sign in at all.
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
 func (p *password) Set(plaintextPassword string) error {
 	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
 	if err != nil {
@@ -163,7 +172,7 @@ func (m UserModel) Update(user *User) error {
 			return err
 		}
 	}
-	return nil
+	return m.Cache.invalidateUser(user.ID)
 }
 
 func (m UserModel) GetByEmail(email string) (*User, error) {
@@ -176,7 +185,9 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	    password_hash,
 	    created_at,
 	    last_updated,
-	    activated
+	    activated,
+	    totp_enabled,
+	    disabled_at
 		FROM users
 		WHERE email = $1`
 
@@ -194,6 +205,8 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.CreatedAt,
 		&user.LastUpdated,
 		&user.Activated,
+		&user.MFAEnabled,
+		&user.DisabledAt,
 	)
 
 	if err != nil {
@@ -207,9 +220,52 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (m UserModel) GetByToken(tokenScope Scope, tokenPlaintext string) (*User, error) {
-	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+func (m UserModel) Get(id uuid.UUID) (*User, error) {
+	query := `
+		SELECT 
+	    id,
+	    email,
+	    first_name,
+	    last_name,
+	    password_hash,
+	    created_at,
+	    last_updated,
+	    activated,
+	    totp_enabled,
+	    disabled_at
+		FROM users
+		WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password.hash,
+		&user.CreatedAt,
+		&user.LastUpdated,
+		&user.Activated,
+		&user.MFAEnabled,
+		&user.DisabledAt,
+	)
 
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+func (m UserModel) GetByToken(tokenScope Scope, tokenPlaintext string) (*User, error) {
 	query := `
 		SELECT
 	    users.id,
@@ -219,7 +275,9 @@ func (m UserModel) GetByToken(tokenScope Scope, tokenPlaintext string) (*User, e
 	    users.password_hash,
 	    users.created_at,
 	    users.last_updated,
-	    users.activated
+	    users.activated,
+	    users.totp_enabled,
+	    users.disabled_at
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
@@ -227,7 +285,7 @@ func (m UserModel) GetByToken(tokenScope Scope, tokenPlaintext string) (*User, e
 		AND tokens.scope = $2
 		AND tokens.expiry > $3`
 
-	args := []any{tokenHash[:], tokenScope, time.Now()}
+	args := []any{hashTokenPlaintext(tokenPlaintext), tokenScope, time.Now()}
 
 	var user User
 
@@ -243,6 +301,8 @@ func (m UserModel) GetByToken(tokenScope Scope, tokenPlaintext string) (*User, e
 		&user.CreatedAt,
 		&user.LastUpdated,
 		&user.Activated,
+		&user.MFAEnabled,
+		&user.DisabledAt,
 	)
 	if err != nil {
 		switch {
@@ -255,3 +315,349 @@ func (m UserModel) GetByToken(tokenScope Scope, tokenPlaintext string) (*User, e
 
 	return &user, nil
 }
+
+// GetByAuthenticationToken works like GetByToken for the authentication scope
+// but also returns the matching token, so callers know which session the
+// request belongs to.
+func (m UserModel) GetByAuthenticationToken(tokenPlaintext string) (*User, *Token, error) {
+	return m.Cache.getSession(hashTokenPlaintext(tokenPlaintext), func() (*User, *Token, error) {
+		return m.getByAuthenticationToken(tokenPlaintext)
+	})
+}
+
+func (m UserModel) getByAuthenticationToken(tokenPlaintext string) (*User, *Token, error) {
+	query := `
+		SELECT
+	    users.id,
+	    users.email,
+	    users.first_name,
+	    users.last_name,
+	    users.password_hash,
+	    users.created_at,
+	    users.last_updated,
+	    users.activated,
+	    users.totp_enabled,
+	    users.disabled_at,
+	    tokens.expiry,
+	    tokens.family,
+	    tokens.organization_id,
+	    tokens.impersonator_id
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3
+		AND users.disabled_at IS NULL`
+
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      hashTokenPlaintext(tokenPlaintext),
+		Scope:     ScopeAuthentication,
+	}
+
+	args := []any{token.Hash, token.Scope, time.Now()}
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password.hash,
+		&user.CreatedAt,
+		&user.LastUpdated,
+		&user.Activated,
+		&user.MFAEnabled,
+		&user.DisabledAt,
+		&token.Expiry,
+		&token.Family,
+		&token.OrganizationID,
+		&token.ImpersonatorID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	token.UserID = user.ID
+
+	return &user, &token, nil
+}
+
+// GetByStatelessToken returns the user of a verified token that isn't
+// stored in the database, like a PASETO token, together with the token. If
+// checkDenylist is set, tokens whose family is on the denylist are treated
+// as not found. The result is cached like that of GetByAuthenticationToken.
+func (m UserModel) GetByStatelessToken(token *Token, checkDenylist bool) (*User, *Token, error) {
+	return m.Cache.getSession(hashTokenPlaintext(token.Plaintext), func() (*User, *Token, error) {
+		return m.getByStatelessToken(*token, checkDenylist)
+	})
+}
+
+func (m UserModel) getByStatelessToken(token Token, checkDenylist bool) (*User, *Token, error) {
+	query := `
+		SELECT
+	    id,
+	    email,
+	    first_name,
+	    last_name,
+	    password_hash,
+	    created_at,
+	    last_updated,
+	    activated,
+	    totp_enabled,
+	    disabled_at
+		FROM users
+		WHERE id = $1
+		AND disabled_at IS NULL
+		AND NOT ($2 AND EXISTS (
+			SELECT 1
+			FROM token_denylist
+			WHERE family = $3 AND expiry > $4
+		))`
+
+	args := []any{token.UserID, checkDenylist, token.Family, time.Now()}
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password.hash,
+		&user.CreatedAt,
+		&user.LastUpdated,
+		&user.Activated,
+		&user.MFAEnabled,
+		&user.DisabledAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return &user, &token, nil
+}
+
+// Disable marks the user as disabled since the given time. Update never
+// touches the mark, so only Enable clears it again.
+func (m UserModel) Disable(id uuid.UUID, at time.Time) error {
+	query := `
+		UPDATE users
+		SET disabled_at = $1
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, at, id)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidateUser(id)
+}
+
+// Enable clears the mark Disable set.
+func (m UserModel) Enable(id uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET disabled_at = NULL
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidateUser(id)
+}
+
+// ScheduleDeletion marks the user to be deleted for good at the given time.
+func (m UserModel) ScheduleDeletion(id uuid.UUID, at time.Time) error {
+	query := `
+		UPDATE users
+		SET deletion_scheduled_at = $1
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, at, id)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidateUser(id)
+}
+
+// CancelDeletion clears a scheduled deletion. It returns ErrRecordNotFound
+// if the user wasn't scheduled for deletion.
+func (m UserModel) CancelDeletion(id uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET deletion_scheduled_at = NULL
+		WHERE id = $1 AND deletion_scheduled_at IS NOT NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return m.Cache.invalidateUser(id)
+}
+
+// DeleteScheduled deletes every user whose scheduled deletion is due and
+// returns how many were deleted. Everything else stored about them goes
+// with them through ON DELETE CASCADE.
+func (m UserModel) DeleteScheduled() (int64, error) {
+	query := `
+		DELETE FROM users
+		WHERE deletion_scheduled_at <= $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	if result.RowsAffected() > 0 {
+		err = m.Cache.invalidateAll()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// UserFilter narrows down the users listed by GetAll. Empty fields don't
+// filter anything.
+type UserFilter struct {
+	Email         string
+	Activated     *bool
+	Disabled      *bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+func (m UserModel) GetAll(filter UserFilter, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT
+	    count(*) OVER(),
+	    id,
+	    email,
+	    first_name,
+	    last_name,
+	    password_hash,
+	    created_at,
+	    last_updated,
+	    activated,
+	    totp_enabled,
+	    disabled_at
+		FROM users
+		WHERE (strpos(email, $1) > 0 OR $1 = '')
+		AND ($2::boolean IS NULL OR activated = $2)
+		AND ($3::boolean IS NULL OR (disabled_at IS NOT NULL) = $3)
+		AND ($4::timestamptz IS NULL OR created_at >= $4)
+		AND ($5::timestamptz IS NULL OR created_at < $5)
+		ORDER BY %s %s, id ASC
+		LIMIT $6 OFFSET $7`, filters.sortColumn(), filters.sortDirection())
+
+	args := []any{filter.Email, filter.Activated, filter.Disabled, filter.CreatedAfter, filter.CreatedBefore, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password.hash,
+			&user.CreatedAt,
+			&user.LastUpdated,
+			&user.Activated,
+			&user.MFAEnabled,
+			&user.DisabledAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+func (m UserModel) Delete(id uuid.UUID) error {
+	query := `
+		DELETE FROM users
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	err = m.Cache.invalidateUser(id)
+	if err != nil {
+		return err
+	}
+
+	return m.Cache.invalidatePermissions(id)
+}
@@ -0,0 +1,215 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/lieberdev/go-rest-template/internal/validator"
+)
+
+var (
+	ErrDuplicateCredential = errors.New("duplicate credential")
+)
+
+// WebAuthnCredential is a passkey or security key registered by a user.
+// Session is the token family it was registered from.
+type WebAuthnCredential struct {
+	ID           uuid.UUID  `json:"id"`
+	UserID       uuid.UUID  `json:"-"`
+	Session      *uuid.UUID `json:"-"`
+	Name         string     `json:"name"`
+	CredentialID []byte     `json:"-"`
+	PublicKey    []byte     `json:"-"`
+	SignCount    uint32     `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+type WebAuthnModel struct {
+	DB *pgxpool.Pool
+}
+
+func ValidateWebAuthnCredential(v *validator.Validator, credential *WebAuthnCredential) {
+	v.Check(credential.Name != "", "name", "must be provided")
+	v.Check(len(credential.Name) <= 100, "name", "must not be more than 100 bytes long")
+}
+
+func (m WebAuthnModel) Insert(credential *WebAuthnCredential) error {
+	query := `
+		INSERT INTO webauthn_credentials (user_id, name, credential_id, public_key, sign_count, session)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []any{
+		credential.UserID,
+		credential.Name,
+		credential.CredentialID,
+		credential.PublicKey,
+		int64(credential.SignCount),
+		credential.Session,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&credential.ID, &credential.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == UniqueConstraint("webauthn_credentials", "credential_id"):
+			return ErrDuplicateCredential
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m WebAuthnModel) GetAllForUser(userID uuid.UUID) ([]*WebAuthnCredential, error) {
+	query := `
+		SELECT id, user_id, session, name, credential_id, public_key, sign_count, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at`
+
+	return m.getAll(query, userID)
+}
+
+// DeleteAllForSession deletes the credentials the user registered from the
+// session and returns them.
+func (m WebAuthnModel) DeleteAllForSession(userID uuid.UUID, session uuid.UUID) ([]*WebAuthnCredential, error) {
+	query := `
+		WITH deleted AS (
+			DELETE FROM webauthn_credentials
+			WHERE user_id = $1 AND session = $2
+			RETURNING id, user_id, session, name, credential_id, public_key, sign_count, created_at, last_used_at
+		)
+		SELECT id, user_id, session, name, credential_id, public_key, sign_count, created_at, last_used_at
+		FROM deleted
+		ORDER BY created_at`
+
+	return m.getAll(query, userID, session)
+}
+
+func (m WebAuthnModel) getAll(query string, args ...any) ([]*WebAuthnCredential, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []*WebAuthnCredential{}
+	for rows.Next() {
+		var credential WebAuthnCredential
+		var signCount int64
+		err := rows.Scan(
+			&credential.ID,
+			&credential.UserID,
+			&credential.Session,
+			&credential.Name,
+			&credential.CredentialID,
+			&credential.PublicKey,
+			&signCount,
+			&credential.CreatedAt,
+			&credential.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		credential.SignCount = uint32(signCount)
+		credentials = append(credentials, &credential)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+func (m WebAuthnModel) GetForUser(credentialID []byte, userID uuid.UUID) (*WebAuthnCredential, error) {
+	query := `
+		SELECT id, user_id, session, name, credential_id, public_key, sign_count, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE credential_id = $1 AND user_id = $2`
+
+	var credential WebAuthnCredential
+	var signCount int64
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, credentialID, userID).Scan(
+		&credential.ID,
+		&credential.UserID,
+		&credential.Session,
+		&credential.Name,
+		&credential.CredentialID,
+		&credential.PublicKey,
+		&signCount,
+		&credential.CreatedAt,
+		&credential.LastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	credential.SignCount = uint32(signCount)
+
+	return &credential, nil
+}
+
+// UpdateSignCount stores the sign count of a successful assertion. It
+// returns ErrEditConflict if a concurrent assertion already stored a count
+// at least as high.
+func (m WebAuthnModel) UpdateSignCount(id uuid.UUID, signCount uint32) error {
+	query := `
+		UPDATE webauthn_credentials
+		SET sign_count = $1, last_used_at = $2
+		WHERE id = $3 AND (sign_count < $1 OR $1 = 0)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, int64(signCount), time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+func (m WebAuthnModel) DeleteForUser(id uuid.UUID, userID uuid.UUID) error {
+	query := `
+		DELETE FROM webauthn_credentials
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,429 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// signingKey is a key of the fake issuer, published in its JWKS.
+type signingKey struct {
+	id     string
+	alg    string
+	signer crypto.Signer
+}
+
+func newSigningKey(t *testing.T, id string, alg string) signingKey {
+	t.Helper()
+
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingKey{id: id, alg: alg, signer: signer}
+}
+
+func (k signingKey) jwk() map[string]string {
+	switch key := k.signer.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"kid": k.id,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+		return map[string]string{
+			"kty": "EC",
+			"kid": k.id,
+			"use": "sig",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(x),
+			"y":   base64.RawURLEncoding.EncodeToString(y),
+		}
+	default:
+		panic("unsupported key")
+	}
+}
+
+func (k signingKey) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": k.alg, "typ": "JWT", "kid": k.id})
+	payload, _ := json.Marshal(claims)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch key := k.signer.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// fakeIssuer is an OpenID provider serving discovery, a JWKS and a token
+// endpoint that checks the PKCE code verifier.
+type fakeIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu sync.Mutex
+	// published are the keys in the JWKS; signWith signs ID tokens.
+	published    []signingKey
+	signWith     signingKey
+	jwksRequests int
+	// challenge and nonce are those of the last authorization request.
+	challenge string
+	nonce     string
+	// modify changes the claims of the next ID token.
+	modify func(claims map[string]any)
+}
+
+const (
+	testClientID     = "client"
+	testClientSecret = "secret"
+	testRedirectURL  = "https://app.example/callback"
+	testCode         = "authorization-code"
+)
+
+func newFakeIssuer(t *testing.T, key signingKey) *fakeIssuer {
+	t.Helper()
+
+	issuer := &fakeIssuer{t: t, published: []signingKey{key}, signWith: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("GET /jwks", issuer.jwks)
+	mux.HandleFunc("POST /token", issuer.token)
+
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+func (f *fakeIssuer) provider() *Provider {
+	return NewProvider(ProviderConfig{
+		Name:         "fake",
+		Issuer:       f.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+	})
+}
+
+func (f *fakeIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 f.server.URL,
+		"authorization_endpoint": f.server.URL + "/authorize",
+		"token_endpoint":         f.server.URL + "/token",
+		"jwks_uri":               f.server.URL + "/jwks",
+	})
+}
+
+func (f *fakeIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.jwksRequests++
+
+	keys := []map[string]string{}
+	for _, key := range f.published {
+		keys = append(keys, key.jwk())
+	}
+	json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
+
+func (f *fakeIssuer) jwksRequestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.jwksRequests
+}
+
+func (f *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code",
+		r.PostForm.Get("code") != testCode,
+		r.PostForm.Get("client_id") != testClientID,
+		r.PostForm.Get("client_secret") != testClientSecret,
+		r.PostForm.Get("redirect_uri") != testRedirectURL,
+		CodeChallenge(r.PostForm.Get("code_verifier")) != f.challenge:
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":            f.server.URL,
+		"sub":            "subject",
+		"aud":            testClientID,
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          f.nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice Example",
+	}
+	if f.modify != nil {
+		f.modify(claims)
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"id_token":     f.signWith.sign(f.t, claims),
+	})
+}
+
+// authorize plays the user's part at the authorization endpoint: it checks
+// the authorization URL and remembers its PKCE challenge and nonce.
+func (f *fakeIssuer) authorize(authorizationURL string, state string) {
+	f.t.Helper()
+
+	u, err := url.Parse(authorizationURL)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	if got := u.Scheme + "://" + u.Host + u.Path; got != f.server.URL+"/authorize" {
+		f.t.Fatalf("got authorization endpoint %q", got)
+	}
+
+	query := u.Query()
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"state":                 state,
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := query.Get(name); got != value {
+			f.t.Errorf("got %s %q; want %q", name, got, value)
+		}
+	}
+	if !strings.Contains(" "+query.Get("scope")+" ", " openid ") {
+		f.t.Errorf("scope %q lacks openid", query.Get("scope"))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.challenge = query.Get("code_challenge")
+	f.nonce = query.Get("nonce")
+}
+
+// login runs the authorization code flow and returns the result of the
+// exchange.
+func login(t *testing.T, issuer *fakeIssuer, provider *Provider) (*Claims, error) {
+	t.Helper()
+
+	state, nonce, verifier := mustVerifier(t), mustVerifier(t), mustVerifier(t)
+
+	authorizationURL, err := provider.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.authorize(authorizationURL, state)
+
+	return provider.Exchange(context.Background(), testCode, verifier, nonce)
+}
+
+func mustVerifier(t *testing.T) string {
+	t.Helper()
+
+	verifier, err := GenerateVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verifier
+}
+
+func TestExchange(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256"} {
+		t.Run(alg, func(t *testing.T) {
+			issuer := newFakeIssuer(t, newSigningKey(t, "key-1", alg))
+
+			claims, err := login(t, issuer, issuer.provider())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if claims.Subject != "subject" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestExchangeRejectsWrongVerifierAndNonce(t *testing.T) {
+	issuer := newFakeIssuer(t, newSigningKey(t, "key-1", "ES256"))
+	provider := issuer.provider()
+
+	state, nonce, verifier := mustVerifier(t), mustVerifier(t), mustVerifier(t)
+
+	authorizationURL, err := provider.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.authorize(authorizationURL, state)
+
+	// The token endpoint refuses the code without the matching verifier.
+	_, err = provider.Exchange(context.Background(), testCode, mustVerifier(t), nonce)
+	if err == nil {
+		t.Error("exchange with the wrong code verifier succeeded")
+	}
+
+	// An ID token issued for another authorization request is refused.
+	_, err = provider.Exchange(context.Background(), testCode, verifier, mustVerifier(t))
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("wrong nonce: got error %v; want %v", err, ErrInvalidIDToken)
+	}
+}
+
+func TestExchangeRejectsInvalidIDTokens(t *testing.T) {
+	key := newSigningKey(t, "key-1", "RS256")
+	forged := newSigningKey(t, "key-1", "RS256")
+
+	tests := []struct {
+		name     string
+		modify   func(claims map[string]any)
+		signWith *signingKey
+		err      error
+	}{
+		{name: "wrong issuer", modify: func(c map[string]any) { c["iss"] = "https://evil.example" }, err: ErrInvalidIDToken},
+		{name: "wrong audience", modify: func(c map[string]any) { c["aud"] = "other-client" }, err: ErrInvalidIDToken},
+		{name: "audience list without client", modify: func(c map[string]any) { c["aud"] = []string{"a", "b"} }, err: ErrInvalidIDToken},
+		{name: "expired", modify: func(c map[string]any) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, err: ErrInvalidIDToken},
+		{name: "issued in the future", modify: func(c map[string]any) { c["iat"] = time.Now().Add(time.Hour).Unix() }, err: ErrInvalidIDToken},
+		{name: "missing nonce", modify: func(c map[string]any) { delete(c, "nonce") }, err: ErrInvalidIDToken},
+		{name: "missing subject", modify: func(c map[string]any) { delete(c, "sub") }, err: ErrInvalidIDToken},
+		{name: "forged signature", signWith: &forged, err: ErrInvalidIDToken},
+		{name: "email not verified", modify: func(c map[string]any) { c["email_verified"] = false }, err: ErrUnverifiedEmail},
+		{name: "email verified as string false", modify: func(c map[string]any) { c["email_verified"] = "false" }, err: ErrUnverifiedEmail},
+		{name: "email verification missing", modify: func(c map[string]any) { delete(c, "email_verified") }, err: ErrUnverifiedEmail},
+		{name: "email missing", modify: func(c map[string]any) { delete(c, "email") }, err: ErrUnverifiedEmail},
+		{name: "audience list with client", modify: func(c map[string]any) { c["aud"] = []string{"other", testClientID} }},
+		{name: "email verified as string true", modify: func(c map[string]any) { c["email_verified"] = "true" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := newFakeIssuer(t, key)
+			issuer.modify = tt.modify
+			if tt.signWith != nil {
+				issuer.signWith = *tt.signWith
+			}
+
+			_, err := login(t, issuer, issuer.provider())
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v; want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestExchangeRefetchesJWKSForUnknownKeys(t *testing.T) {
+	oldKey := newSigningKey(t, "old", "ES256")
+	newKey := newSigningKey(t, "new", "RS256")
+
+	issuer := newFakeIssuer(t, oldKey)
+	provider := issuer.provider()
+
+	_, err := login(t, issuer, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The provider rotates its keys.
+	issuer.mu.Lock()
+	issuer.published = []signingKey{newKey}
+	issuer.signWith = newKey
+	issuer.mu.Unlock()
+
+	// The JWKS was just fetched, so an unknown key isn't looked up again
+	// right away.
+	_, err = login(t, issuer, provider)
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("got error %v; want %v", err, ErrInvalidIDToken)
+	}
+	if n := issuer.jwksRequestCount(); n != 1 {
+		t.Errorf("got %d JWKS requests; want 1", n)
+	}
+
+	provider.mu.Lock()
+	provider.keys.fetchedAt = time.Now().Add(-2 * time.Minute)
+	provider.mu.Unlock()
+
+	_, err = login(t, issuer, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := issuer.jwksRequestCount(); n != 2 {
+		t.Errorf("got %d JWKS requests; want 2", n)
+	}
+
+	// Tokens signed with the retired key are refused once it's gone.
+	issuer.mu.Lock()
+	issuer.signWith = oldKey
+	issuer.mu.Unlock()
+
+	_, err = login(t, issuer, provider)
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("retired key: got error %v; want %v", err, ErrInvalidIDToken)
+	}
+}
@@ -0,0 +1,175 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+type policySpec struct {
+	Name      string         `json:"name"`
+	Effect    Effect         `json:"effect"`
+	Resources []string       `json:"resources"`
+	Actions   []string       `json:"actions"`
+	When      *conditionSpec `json:"when"`
+}
+
+// conditionSpec is the declarative form of a condition. Every field that is
+// set has to hold, and at least one has to be set.
+type conditionSpec struct {
+	// Always makes a condition that holds for every request explicit.
+	Always bool `json:"always"`
+	// Owner requires the subject to own the resource.
+	Owner bool `json:"owner"`
+	// Permission requires the subject to have the permission.
+	Permission string `json:"permission"`
+	// Attributes requires resource attributes to have the given values.
+	Attributes map[string]any `json:"attributes"`
+	// SameAttributes requires resource attributes, the keys, to equal
+	// subject attributes, the values.
+	SameAttributes map[string]string `json:"same_attributes"`
+	Any            []conditionSpec   `json:"any"`
+	All            []conditionSpec   `json:"all"`
+	Not            *conditionSpec    `json:"not"`
+}
+
+// LoadFile reads policies from a JSON file of the form
+// {"policies": [{"name": "...", "effect": "allow", "resources": ["..."],
+// "actions": ["..."], "when": {"owner": true}}]}. Policies that apply
+// regardless of the request need "when": {"always": true}, so that a
+// missing or misspelled condition can't grant access to everyone.
+func LoadFile(path string) ([]Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file struct {
+		Policies []policySpec `json:"policies"`
+	}
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+
+	err = dec.Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if dec.More() {
+		return nil, fmt.Errorf("%s: unexpected data after the policies", path)
+	}
+
+	policies := []Policy{}
+	for _, spec := range file.Policies {
+		if spec.Name == "" || len(spec.Resources) == 0 || len(spec.Actions) == 0 {
+			return nil, fmt.Errorf("%s: policies need a name, resources and actions", path)
+		}
+
+		if spec.Effect != Allow && spec.Effect != Deny {
+			return nil, fmt.Errorf("%s: policy %q: effect must be %q or %q", path, spec.Name, Allow, Deny)
+		}
+
+		if spec.When == nil {
+			return nil, fmt.Errorf("%s: policy %q: when must be given, use {\"always\": true} if the policy always applies", path, spec.Name)
+		}
+
+		err = spec.When.validate()
+		if err != nil {
+			return nil, fmt.Errorf("%s: policy %q: %w", path, spec.Name, err)
+		}
+
+		policies = append(policies, Policy{
+			Name:      spec.Name,
+			Effect:    spec.Effect,
+			Resources: spec.Resources,
+			Actions:   spec.Actions,
+			When:      spec.When.condition(),
+		})
+	}
+
+	return policies, nil
+}
+
+// validate rejects empty conditions and converts the attribute values,
+// which have to be strings, numbers or booleans, to the types the
+// conditions compare.
+func (s *conditionSpec) validate() error {
+	if !s.Always && !s.Owner && s.Permission == "" && len(s.Attributes) == 0 &&
+		len(s.SameAttributes) == 0 && len(s.Any) == 0 && len(s.All) == 0 && s.Not == nil {
+		return errors.New("conditions must not be empty, use {\"always\": true} if the policy always applies")
+	}
+
+	for key, value := range s.Attributes {
+		switch value := value.(type) {
+		case string, bool:
+		case json.Number:
+			if n, err := value.Int64(); err == nil {
+				s.Attributes[key] = n
+			} else if f, err := value.Float64(); err == nil {
+				s.Attributes[key] = f
+			} else {
+				return fmt.Errorf("attribute %q: %w", key, err)
+			}
+		default:
+			return fmt.Errorf("attribute %q must be a string, number or boolean", key)
+		}
+	}
+
+	for i := range s.Any {
+		err := s.Any[i].validate()
+		if err != nil {
+			return err
+		}
+	}
+	for i := range s.All {
+		err := s.All[i].validate()
+		if err != nil {
+			return err
+		}
+	}
+	if s.Not != nil {
+		return s.Not.validate()
+	}
+
+	return nil
+}
+
+func (s conditionSpec) condition() Condition {
+	conditions := []Condition{}
+
+	if s.Owner {
+		conditions = append(conditions, Owner())
+	}
+	if s.Permission != "" {
+		conditions = append(conditions, Permission(s.Permission))
+	}
+	for key, value := range s.Attributes {
+		conditions = append(conditions, AttributeEquals(key, value))
+	}
+	for resourceKey, subjectKey := range s.SameAttributes {
+		conditions = append(conditions, SameAttribute(resourceKey, subjectKey))
+	}
+	if len(s.Any) > 0 {
+		conditions = append(conditions, Any(specConditions(s.Any)...))
+	}
+	if len(s.All) > 0 {
+		conditions = append(conditions, All(specConditions(s.All)...))
+	}
+	if s.Not != nil {
+		conditions = append(conditions, Not(s.Not.condition()))
+	}
+
+	return All(conditions...)
+}
+
+func specConditions(specs []conditionSpec) []Condition {
+	conditions := []Condition{}
+	for _, spec := range specs {
+		conditions = append(conditions, spec.condition())
+	}
+	return conditions
+}
@@ -0,0 +1,144 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func writePolicyFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policies.json")
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writePolicyFile(t, `{"policies": [
+		{"name": "public", "effect": "allow", "resources": ["document"], "actions": ["read"], "when": {"always": true}},
+		{"name": "same-org", "effect": "allow", "resources": ["project"], "actions": ["*"], "when": {
+			"same_attributes": {"organization_id": "organization_id"},
+			"any": [{"owner": true}, {"attributes": {"visibility": "internal", "level": 2}}]
+		}},
+		{"name": "archived", "effect": "deny", "resources": ["project"], "actions": ["update"], "when": {
+			"not": {"attributes": {"archived": false}}
+		}}
+	]}`)
+
+	policies, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 3 {
+		t.Fatalf("got %d policies; want 3", len(policies))
+	}
+
+	engine := New(nil, policies...)
+	subject := Subject{ID: uuid.New(), Attributes: map[string]any{"organization_id": "org-1"}}
+
+	tests := []struct {
+		name     string
+		req      Request
+		allowed  bool
+		decision string
+	}{
+		{
+			name:     "always",
+			req:      Request{Action: "read", Resource: Resource{Type: "document"}},
+			allowed:  true,
+			decision: "public",
+		},
+		{
+			name: "same organization and owner",
+			req: Request{Subject: subject, Action: "read", Resource: Resource{
+				Type:       "project",
+				OwnerID:    subject.ID,
+				Attributes: map[string]any{"organization_id": "org-1", "archived": false},
+			}},
+			allowed:  true,
+			decision: "same-org",
+		},
+		{
+			name: "same organization and an int attribute",
+			req: Request{Subject: subject, Action: "read", Resource: Resource{
+				Type:       "project",
+				Attributes: map[string]any{"organization_id": "org-1", "visibility": "internal", "level": 2},
+			}},
+			allowed:  true,
+			decision: "same-org",
+		},
+		{
+			name: "other organization",
+			req: Request{Subject: subject, Action: "read", Resource: Resource{
+				Type:       "project",
+				OwnerID:    subject.ID,
+				Attributes: map[string]any{"organization_id": "org-2"},
+			}},
+		},
+		{
+			name: "archived",
+			req: Request{Subject: subject, Action: "update", Resource: Resource{
+				Type:       "project",
+				OwnerID:    subject.ID,
+				Attributes: map[string]any{"organization_id": "org-1", "archived": true},
+			}},
+			decision: "archived",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := engine.Evaluate(tt.req)
+			if decision.Allowed != tt.allowed || decision.Policy != tt.decision {
+				t.Errorf("got %+v; want {Allowed:%t Policy:%s}", decision, tt.allowed, tt.decision)
+			}
+		})
+	}
+}
+
+func TestLoadFileRejects(t *testing.T) {
+	policy := func(when string) string {
+		return `{"policies": [{"name": "p", "effect": "allow", "resources": ["r"], "actions": ["a"]` + when + `}]}`
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"malformed JSON", `{"policies": [`, "unexpected EOF"},
+		{"unknown top-level field", `{"policies": [], "polices": []}`, "unknown field"},
+		{"unknown policy field", policy(`, "when": {"owner": true}, "condition": {}`), "unknown field"},
+		{"misspelled condition", policy(`, "when": {"ownr": true}`), "unknown field"},
+		{"trailing data", policy(`, "when": {"owner": true}`) + `{}`, "unexpected data"},
+		{"missing name", `{"policies": [{"effect": "allow", "resources": ["r"], "actions": ["a"], "when": {"always": true}}]}`, "need a name"},
+		{"unknown effect", `{"policies": [{"name": "p", "effect": "permit", "resources": ["r"], "actions": ["a"], "when": {"always": true}}]}`, "effect must be"},
+		{"missing when", policy(``), "when must be given"},
+		{"null when", policy(`, "when": null`), "when must be given"},
+		{"empty when", policy(`, "when": {}`), "must not be empty"},
+		{"always false", policy(`, "when": {"always": false}`), "must not be empty"},
+		{"empty any", policy(`, "when": {"any": []}`), "must not be empty"},
+		{"empty nested condition", policy(`, "when": {"any": [{"owner": true}, {}]}`), "must not be empty"},
+		{"empty not", policy(`, "when": {"not": {}}`), "must not be empty"},
+		{"null attribute", policy(`, "when": {"attributes": {"a": null}}`), "must be a string, number or boolean"},
+		{"array attribute", policy(`, "when": {"attributes": {"a": [1]}}`), "must be a string, number or boolean"},
+		{"object attribute", policy(`, "when": {"attributes": {"a": {"b": 1}}}`), "must be a string, number or boolean"},
+		{"nested array attribute", policy(`, "when": {"all": [{"attributes": {"a": []}}]}`), "must be a string, number or boolean"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadFile(writePolicyFile(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v; want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+// Package policy decides whether a subject may perform an action on a
+// resource based on rules about the subject's permissions and the
+// attributes of both, such as "users can edit their own profile".
+package policy
+
+import (
+	"log/slog"
+	"reflect"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+type Effect string
+
+const (
+	Allow Effect = "allow"
+	Deny  Effect = "deny"
+)
+
+// Subject is whoever makes the request.
+type Subject struct {
+	ID uuid.UUID
+	// HasPermission reports whether the subject holds the permission,
+	// taking wildcards and any narrowing by API keys or OAuth2 scopes
+	// into account.
+	HasPermission func(code string) bool
+	Attributes    map[string]any
+}
+
+// Resource is what the action is performed on. OwnerID is the user the
+// resource belongs to, if any.
+type Resource struct {
+	Type       string
+	ID         string
+	OwnerID    uuid.UUID
+	Attributes map[string]any
+}
+
+type Request struct {
+	Subject  Subject
+	Action   string
+	Resource Resource
+}
+
+// Condition reports whether a policy applies to the request.
+type Condition func(req Request) bool
+
+// Policy allows or denies the actions on the resource types it lists when
+// its condition holds. A nil condition always holds. "*" matches any action
+// or resource type.
+type Policy struct {
+	Name      string
+	Effect    Effect
+	Resources []string
+	Actions   []string
+	When      Condition
+}
+
+func (p Policy) applies(req Request) bool {
+	if !matches(p.Resources, req.Resource.Type) || !matches(p.Actions, req.Action) {
+		return false
+	}
+
+	return p.When == nil || p.When(req)
+}
+
+func matches(values []string, value string) bool {
+	return slices.Contains(values, "*") || slices.Contains(values, value)
+}
+
+// Decision is the outcome of evaluating a request. Policy names the policy
+// that decided it and is empty if none applied.
+type Decision struct {
+	Allowed bool
+	Policy  string
+}
+
+// Engine evaluates requests against its policies. A request is allowed if
+// at least one allow policy and no deny policy applies to it.
+type Engine struct {
+	policies []Policy
+	logger   *slog.Logger
+}
+
+// New returns an engine that logs every decision to logger unless it is
+// nil.
+func New(logger *slog.Logger, policies ...Policy) *Engine {
+	return &Engine{policies: policies, logger: logger}
+}
+
+func (e *Engine) Evaluate(req Request) Decision {
+	decision := e.evaluate(req)
+
+	if e.logger != nil {
+		e.logger.Info("policy decision",
+			slog.String("subject", req.Subject.ID.String()),
+			slog.String("action", req.Action),
+			slog.String("resource_type", req.Resource.Type),
+			slog.String("resource_id", req.Resource.ID),
+			slog.Bool("allowed", decision.Allowed),
+			slog.String("policy", decision.Policy),
+		)
+	}
+
+	return decision
+}
+
+func (e *Engine) evaluate(req Request) Decision {
+	var allowedBy string
+
+	for _, policy := range e.policies {
+		if !policy.applies(req) {
+			continue
+		}
+
+		if policy.Effect == Deny {
+			return Decision{Allowed: false, Policy: policy.Name}
+		}
+
+		if allowedBy == "" {
+			allowedBy = policy.Name
+		}
+	}
+
+	return Decision{Allowed: allowedBy != "", Policy: allowedBy}
+}
+
+// Owner holds when the subject owns the resource.
+func Owner() Condition {
+	return func(req Request) bool {
+		return req.Resource.OwnerID != uuid.Nil && req.Resource.OwnerID == req.Subject.ID
+	}
+}
+
+// Permission holds when the subject has the permission.
+func Permission(code string) Condition {
+	return func(req Request) bool {
+		return req.Subject.HasPermission != nil && req.Subject.HasPermission(code)
+	}
+}
+
+// AttributeEquals holds when the resource attribute has the given value.
+// Values are compared as by equal.
+func AttributeEquals(key string, value any) Condition {
+	return func(req Request) bool {
+		attribute, ok := req.Resource.Attributes[key]
+		return ok && equal(attribute, value)
+	}
+}
+
+// SameAttribute holds when the resource attribute equals the subject
+// attribute, e.g. both belong to the same organization. Values are
+// compared as by equal.
+func SameAttribute(resourceKey string, subjectKey string) Condition {
+	return func(req Request) bool {
+		resourceValue, ok := req.Resource.Attributes[resourceKey]
+		if !ok {
+			return false
+		}
+
+		subjectValue, ok := req.Subject.Attributes[subjectKey]
+		return ok && equal(resourceValue, subjectValue)
+	}
+}
+
+// equal reports whether two attribute values are equal. Numbers are equal
+// if they have the same value, whatever their types, so that the float64
+// numbers decoded from JSON match the ints set in code. Other values have
+// to be of the same type, and values that can't be compared, like slices
+// and maps, or nil, are never equal to anything.
+func equal(a any, b any) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+
+	if isNumber(va) || isNumber(vb) {
+		return isNumber(va) && isNumber(vb) && numbersEqual(va, vb)
+	}
+
+	if !va.Comparable() || !vb.Comparable() {
+		return false
+	}
+
+	return a == b
+}
+
+func isNumber(v reflect.Value) bool {
+	return isInt(v) || isUint(v) || isFloat(v)
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isUint(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+func isFloat(v reflect.Value) bool {
+	return v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64
+}
+
+// numbersEqual compares integers exactly and everything else as float64.
+func numbersEqual(a reflect.Value, b reflect.Value) bool {
+	switch {
+	case isInt(a) && isInt(b):
+		return a.Int() == b.Int()
+	case isUint(a) && isUint(b):
+		return a.Uint() == b.Uint()
+	case isInt(a) && isUint(b):
+		return a.Int() >= 0 && uint64(a.Int()) == b.Uint()
+	case isUint(a) && isInt(b):
+		return b.Int() >= 0 && a.Uint() == uint64(b.Int())
+	default:
+		return toFloat(a) == toFloat(b)
+	}
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch {
+	case isInt(v):
+		return float64(v.Int())
+	case isUint(v):
+		return float64(v.Uint())
+	default:
+		return v.Float()
+	}
+}
+
+// All holds when every one of the conditions holds.
+func All(conditions ...Condition) Condition {
+	return func(req Request) bool {
+		for _, condition := range conditions {
+			if !condition(req) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Any holds when at least one of the conditions holds.
+func Any(conditions ...Condition) Condition {
+	return func(req Request) bool {
+		for _, condition := range conditions {
+			if condition(req) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func Not(condition Condition) Condition {
+	return func(req Request) bool {
+		return !condition(req)
+	}
+}
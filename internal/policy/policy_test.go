@@ -0,0 +1,156 @@
+package policy
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestEngineEvaluate(t *testing.T) {
+	owner := uuid.New()
+	other := uuid.New()
+
+	engine := New(nil,
+		Policy{Name: "own-profile", Effect: Allow, Resources: []string{"user"}, Actions: []string{"read", "update"}, When: Owner()},
+		Policy{Name: "read-users", Effect: Allow, Resources: []string{"user"}, Actions: []string{"read"}, When: Permission("users:read")},
+		Policy{Name: "locked", Effect: Deny, Resources: []string{"*"}, Actions: []string{"*"}, When: AttributeEquals("locked", true)},
+		Policy{Name: "public", Effect: Allow, Resources: []string{"document"}, Actions: []string{"read"}},
+	)
+
+	permissions := func(codes ...string) func(string) bool {
+		return func(code string) bool { return slices.Contains(codes, code) }
+	}
+
+	tests := []struct {
+		name     string
+		req      Request
+		allowed  bool
+		decision string
+	}{
+		{
+			name:     "owner",
+			req:      Request{Subject: Subject{ID: owner}, Action: "update", Resource: Resource{Type: "user", OwnerID: owner}},
+			allowed:  true,
+			decision: "own-profile",
+		},
+		{
+			name: "not the owner",
+			req:  Request{Subject: Subject{ID: other}, Action: "update", Resource: Resource{Type: "user", OwnerID: owner}},
+		},
+		{
+			name: "resource without owner",
+			req:  Request{Subject: Subject{}, Action: "update", Resource: Resource{Type: "user"}},
+		},
+		{
+			name:     "permission",
+			req:      Request{Subject: Subject{ID: other, HasPermission: permissions("users:read")}, Action: "read", Resource: Resource{Type: "user", OwnerID: owner}},
+			allowed:  true,
+			decision: "read-users",
+		},
+		{
+			name: "permission for another action",
+			req:  Request{Subject: Subject{ID: other, HasPermission: permissions("users:read")}, Action: "update", Resource: Resource{Type: "user", OwnerID: owner}},
+		},
+		{
+			name: "no permission check",
+			req:  Request{Subject: Subject{ID: other}, Action: "read", Resource: Resource{Type: "user", OwnerID: owner}},
+		},
+		{
+			name:     "deny overrides allow",
+			req:      Request{Subject: Subject{ID: owner}, Action: "update", Resource: Resource{Type: "user", OwnerID: owner, Attributes: map[string]any{"locked": true}}},
+			decision: "locked",
+		},
+		{
+			name:     "deny that doesn't apply",
+			req:      Request{Subject: Subject{ID: owner}, Action: "update", Resource: Resource{Type: "user", OwnerID: owner, Attributes: map[string]any{"locked": false}}},
+			allowed:  true,
+			decision: "own-profile",
+		},
+		{
+			name:     "nil condition",
+			req:      Request{Action: "read", Resource: Resource{Type: "document"}},
+			allowed:  true,
+			decision: "public",
+		},
+		{
+			name: "unknown resource type",
+			req:  Request{Subject: Subject{ID: owner}, Action: "read", Resource: Resource{Type: "invoice", OwnerID: owner}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := engine.Evaluate(tt.req)
+			if decision.Allowed != tt.allowed || decision.Policy != tt.decision {
+				t.Errorf("got %+v; want {Allowed:%t Policy:%s}", decision, tt.allowed, tt.decision)
+			}
+		})
+	}
+}
+
+func TestConditions(t *testing.T) {
+	req := Request{
+		Subject: Subject{Attributes: map[string]any{"organization_id": "org-1", "level": 3}},
+		Resource: Resource{Attributes: map[string]any{
+			"organization_id": "org-1",
+			"other_org":       "org-2",
+			"level":           float64(3),
+			"big":             uint64(1<<63 + 1),
+			"negative":        -1,
+			"tags":            []string{"a"},
+			"meta":            map[string]any{"a": 1},
+			"nothing":         nil,
+			"wrapped":         struct{ V any }{[]int{1}},
+			"flag":            true,
+		}},
+	}
+
+	tests := []struct {
+		name      string
+		condition Condition
+		want      bool
+	}{
+		{"same string", AttributeEquals("organization_id", "org-1"), true},
+		{"other string", AttributeEquals("organization_id", "org-2"), false},
+		{"missing attribute", AttributeEquals("missing", "org-1"), false},
+		{"bool", AttributeEquals("flag", true), true},
+		{"bool and string", AttributeEquals("flag", "true"), false},
+		{"float64 and int", AttributeEquals("level", 3), true},
+		{"float64 and int64", AttributeEquals("level", int64(3)), true},
+		{"float64 and other int", AttributeEquals("level", 4), false},
+		{"number and string", AttributeEquals("level", "3"), false},
+		{"uint64 exactly", AttributeEquals("big", uint64(1<<63+1)), true},
+		{"uint64 and nearby uint64", AttributeEquals("big", uint64(1<<63)), false},
+		{"negative int and uint", AttributeEquals("negative", uint(1<<64-1)), false},
+		{"slice", AttributeEquals("tags", []string{"a"}), false},
+		{"map", AttributeEquals("meta", map[string]any{"a": 1}), false},
+		{"slice and string", AttributeEquals("tags", "a"), false},
+		{"nil", AttributeEquals("nothing", nil), false},
+		{"struct holding a slice", AttributeEquals("wrapped", struct{ V any }{[]int{1}}), false},
+
+		{"same attribute", SameAttribute("organization_id", "organization_id"), true},
+		{"different attribute", SameAttribute("other_org", "organization_id"), false},
+		{"same number of other types", SameAttribute("level", "level"), true},
+		{"missing subject attribute", SameAttribute("organization_id", "missing"), false},
+		{"missing resource attribute", SameAttribute("missing", "organization_id"), false},
+		{"uncomparable resource attribute", SameAttribute("tags", "organization_id"), false},
+
+		{"all of nothing", All(), true},
+		{"all", All(AttributeEquals("flag", true), AttributeEquals("level", 3)), true},
+		{"all with one failing", All(AttributeEquals("flag", true), AttributeEquals("level", 4)), false},
+		{"any of nothing", Any(), false},
+		{"any", Any(AttributeEquals("flag", false), AttributeEquals("level", 3)), true},
+		{"any with none holding", Any(AttributeEquals("flag", false), AttributeEquals("level", 4)), false},
+		{"not", Not(AttributeEquals("flag", false)), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.condition(req)
+			if got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// cborMap is a map encoded with its keys in the given order, as alternating
+// keys and values.
+type cborMap []any
+
+// cborEncode encodes the values decodeCBOR supports.
+func cborEncode(v any) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []any:
+		data := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			data = append(data, cborEncode(item)...)
+		}
+		return data
+	case cborMap:
+		data := cborHead(5, uint64(len(v)/2))
+		for _, item := range v {
+			data = append(data, cborEncode(item)...)
+		}
+		return data
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	default:
+		panic("unsupported CBOR value")
+	}
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	data := cborEncode(cborMap{
+		1, -7,
+		"bytes", []byte{1, 2, 3},
+		"list", []any{true, false, nil, 1000, -1000},
+		"nested", cborMap{"text", "value"},
+	})
+	data = append(data, 0xff)
+
+	value, rest, err := decodeCBOR(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[any]any{
+		int64(1): int64(-7),
+		"bytes":  []byte{1, 2, 3},
+		"list":   []any{true, false, nil, int64(1000), int64(-1000)},
+		"nested": map[any]any{"text": "value"},
+	}
+	if !reflect.DeepEqual(value, want) {
+		t.Errorf("got %#v; want %#v", value, want)
+	}
+	if !bytes.Equal(rest, []byte{0xff}) {
+		t.Errorf("got remaining bytes %x; want ff", rest)
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated argument", []byte{0x19, 0x01}},
+		{"truncated byte string", []byte{0x45, 1, 2}},
+		{"truncated array", []byte{0x83, 0x01}},
+		{"truncated map", []byte{0xa1, 0x01}},
+		{"array longer than data", cborHead(4, 1<<40)},
+		{"map longer than data", cborHead(5, 1<<40)},
+		{"integer overflow", cborHead(0, 1<<63)},
+		{"negative integer overflow", cborHead(1, 1<<63)},
+		{"indefinite length", []byte{0x9f, 0x01, 0xff}},
+		{"reserved additional information", []byte{0x1c}},
+		{"tag", []byte{0xc0, 0x01}},
+		{"float", []byte{0xf9, 0x3c, 0x00}},
+		{"byte string map key", cborEncode(cborMap{[]byte{1}, 1})},
+		{"array map key", cborEncode(cborMap{[]any{}, 1})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeCBOR(tt.data)
+			if !errors.Is(err, errMalformedCBOR) {
+				t.Errorf("got error %v; want %v", err, errMalformedCBOR)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORDepth(t *testing.T) {
+	nested := func(depth int, container byte) []byte {
+		data := bytes.Repeat([]byte{container}, depth)
+		if container == 0xa1 {
+			// Each map has a single entry whose value is the next map.
+			data = nil
+			for range depth {
+				data = append(data, 0xa1, 0x00)
+			}
+		}
+		return append(data, 0x00)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"arrays within the limit", nested(maxCBORDepth-1, 0x81), true},
+		{"arrays beyond the limit", nested(maxCBORDepth, 0x81), false},
+		{"maps beyond the limit", nested(maxCBORDepth, 0xa1), false},
+		{"deeply nested arrays", nested(1_000_000, 0x81), false},
+		{"deeply nested maps", nested(1_000_000, 0xa1), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeCBOR(tt.data)
+			if tt.ok && err != nil {
+				t.Errorf("got error %v", err)
+			}
+			if !tt.ok && !errors.Is(err, errMalformedCBOR) {
+				t.Errorf("got error %v; want %v", err, errMalformedCBOR)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+// Package webauthn implements the relying party side of the WebAuthn
+// registration and assertion ceremonies. Attestation statements are not
+// verified, so it should be used with attestation conveyance "none".
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+)
+
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+)
+
+var (
+	ErrInvalidCeremony = errors.New("invalid webauthn ceremony")
+	ErrSignCount       = errors.New("credential sign count did not increase")
+)
+
+type Config struct {
+	RPID    string
+	RPName  string
+	Origins []string
+}
+
+// Credential is a registered public key credential.
+type Credential struct {
+	ID        []byte
+	PublicKey []byte
+	SignCount uint32
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// DecodeBase64 decodes the unpadded base64url encoding WebAuthn uses for
+// binary values, tolerating padding.
+func DecodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func EncodeBase64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Challenge returns the challenge the client data was created for, so the
+// caller can look up the ceremony it belongs to.
+func Challenge(clientDataJSON []byte) ([]byte, error) {
+	var data clientData
+	err := json.Unmarshal(clientDataJSON, &data)
+	if err != nil {
+		return nil, ErrInvalidCeremony
+	}
+
+	challenge, err := DecodeBase64(data.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return nil, ErrInvalidCeremony
+	}
+
+	return challenge, nil
+}
+
+// VerifyRegistration checks the response to a navigator.credentials.create()
+// call made with the given challenge and returns the new credential.
+func (c Config) VerifyRegistration(challenge []byte, clientDataJSON []byte, attestationObject []byte) (*Credential, error) {
+	err := c.verifyClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	value, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, ErrInvalidCeremony
+	}
+
+	attestation, ok := value.(map[any]any)
+	if !ok {
+		return nil, ErrInvalidCeremony
+	}
+
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, ErrInvalidCeremony
+	}
+
+	authData, err := c.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	if authData.flags&flagAttestedCredentialData == 0 {
+		return nil, ErrInvalidCeremony
+	}
+
+	return &Credential{
+		ID:        authData.credentialID,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// VerifyAssertion checks the response to a navigator.credentials.get() call
+// made with the given challenge against a registered credential. It returns
+// the new sign count to store for the credential.
+func (c Config) VerifyAssertion(challenge []byte, credential Credential, clientDataJSON []byte, rawAuthData []byte, signature []byte) (uint32, error) {
+	err := c.verifyClientData(clientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+
+	authData, err := c.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+
+	publicKey, _, err := parseCOSEKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(bytes.Clone(rawAuthData), clientDataHash[:]...)
+
+	if !verifySignature(publicKey, signed, signature) {
+		return 0, ErrInvalidCeremony
+	}
+
+	// Authenticators that don't implement a sign count always report zero.
+	// Otherwise the count must increase, or the credential may be cloned.
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return 0, ErrSignCount
+	}
+
+	return authData.signCount, nil
+}
+
+func (c Config) verifyClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	var data clientData
+	err := json.Unmarshal(clientDataJSON, &data)
+	if err != nil {
+		return ErrInvalidCeremony
+	}
+
+	if data.Type != ceremony {
+		return ErrInvalidCeremony
+	}
+
+	received, err := DecodeBase64(data.Challenge)
+	if err != nil || !bytes.Equal(received, challenge) {
+		return ErrInvalidCeremony
+	}
+
+	if !slices.Contains(c.Origins, data.Origin) {
+		return ErrInvalidCeremony
+	}
+
+	return nil
+}
+
+func (c Config) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, ErrInvalidCeremony
+	}
+
+	authData := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return nil, ErrInvalidCeremony
+	}
+
+	// Passkeys sign users in without a password or second factor, so the
+	// authenticator must have verified the user, e.g. by PIN or biometrics.
+	if authData.flags&flagUserPresent == 0 || authData.flags&flagUserVerified == 0 {
+		return nil, ErrInvalidCeremony
+	}
+
+	if authData.flags&flagAttestedCredentialData != 0 {
+		// AAGUID (16 bytes), credential ID length (2 bytes), credential ID
+		// and the credential public key as a COSE_Key.
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, ErrInvalidCeremony
+		}
+
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLength {
+			return nil, ErrInvalidCeremony
+		}
+		authData.credentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, remaining, err := parseCOSEKey(rest)
+		if err != nil {
+			return nil, err
+		}
+		authData.publicKey = rest[:len(rest)-len(remaining)]
+	}
+
+	return authData, nil
+}
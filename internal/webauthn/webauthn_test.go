@@ -0,0 +1,278 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+var testConfig = Config{
+	RPID:    "example.com",
+	RPName:  "Example",
+	Origins: []string{"https://example.com"},
+}
+
+// authenticator is a software authenticator with a single ES256 credential.
+type authenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	rpID         string
+	flags        byte
+	signCount    uint32
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &authenticator{
+		t:            t,
+		key:          key,
+		credentialID: []byte("credential-id"),
+		rpID:         testConfig.RPID,
+		flags:        flagUserPresent | flagUserVerified,
+	}
+}
+
+func (a *authenticator) publicKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+
+	return cborEncode(cborMap{
+		1, 2,
+		3, AlgES256,
+		-1, 1,
+		-2, x,
+		-3, y,
+	})
+}
+
+func (a *authenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+
+	data := bytes.Clone(rpIDHash[:])
+	flags := a.flags
+	if attested {
+		flags |= flagAttestedCredentialData
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.publicKey()...)
+	}
+
+	return data
+}
+
+// create answers navigator.credentials.create() with "none" attestation.
+func (a *authenticator) create(challenge []byte, origin string) ([]byte, []byte) {
+	clientDataJSON := a.clientData("webauthn.create", challenge, origin)
+
+	attestationObject := cborEncode(cborMap{
+		"fmt", "none",
+		"attStmt", cborMap{},
+		"authData", a.authData(true),
+	})
+
+	return clientDataJSON, attestationObject
+}
+
+// get answers navigator.credentials.get(), signing with the given key.
+func (a *authenticator) get(challenge []byte, origin string, key *ecdsa.PrivateKey) ([]byte, []byte, []byte) {
+	clientDataJSON := a.clientData("webauthn.get", challenge, origin)
+	authData := a.authData(false)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	hash := sha256.Sum256(append(bytes.Clone(authData), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return clientDataJSON, authData, signature
+}
+
+func (a *authenticator) clientData(ceremony string, challenge []byte, origin string) []byte {
+	data, err := json.Marshal(clientData{
+		Type:      ceremony,
+		Challenge: EncodeBase64(challenge),
+		Origin:    origin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return data
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	challenge := []byte("registration-challenge")
+
+	tests := []struct {
+		name   string
+		modify func(a *authenticator)
+		origin string
+		ok     bool
+	}{
+		{"valid", func(a *authenticator) {}, "https://example.com", true},
+		{"wrong origin", func(a *authenticator) {}, "https://evil.example", false},
+		{"wrong rpIdHash", func(a *authenticator) { a.rpID = "evil.example" }, "https://example.com", false},
+		{"user not present", func(a *authenticator) { a.flags = flagUserVerified }, "https://example.com", false},
+		{"user not verified", func(a *authenticator) { a.flags = flagUserPresent }, "https://example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthenticator(t)
+			a.signCount = 1
+			tt.modify(a)
+
+			clientDataJSON, attestationObject := a.create(challenge, tt.origin)
+
+			credential, err := testConfig.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+			if !tt.ok {
+				if !errors.Is(err, ErrInvalidCeremony) {
+					t.Errorf("got error %v; want %v", err, ErrInvalidCeremony)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(credential.ID, a.credentialID) {
+				t.Errorf("got credential ID %q; want %q", credential.ID, a.credentialID)
+			}
+			if !bytes.Equal(credential.PublicKey, a.publicKey()) {
+				t.Error("public key doesn't match the authenticator's")
+			}
+			if credential.SignCount != 1 {
+				t.Errorf("got sign count %d; want 1", credential.SignCount)
+			}
+		})
+	}
+}
+
+func TestVerifyRegistrationRejectsOtherCeremonies(t *testing.T) {
+	a := newAuthenticator(t)
+	challenge := []byte("registration-challenge")
+
+	_, attestationObject := a.create(challenge, "https://example.com")
+
+	tests := []struct {
+		name           string
+		clientDataJSON []byte
+	}{
+		{"assertion client data", a.clientData("webauthn.get", challenge, "https://example.com")},
+		{"other challenge", a.clientData("webauthn.create", []byte("other"), "https://example.com")},
+		{"malformed client data", []byte("{")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testConfig.VerifyRegistration(challenge, tt.clientDataJSON, attestationObject)
+			if !errors.Is(err, ErrInvalidCeremony) {
+				t.Errorf("got error %v; want %v", err, ErrInvalidCeremony)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	challenge := []byte("login-challenge")
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		storedCount   uint32
+		assertedCount uint32
+		modify        func(a *authenticator)
+		origin        string
+		otherKey      bool
+		err           error
+	}{
+		{name: "valid", storedCount: 1, assertedCount: 2, origin: "https://example.com"},
+		{name: "no sign count", storedCount: 0, assertedCount: 0, origin: "https://example.com"},
+		{name: "sign count regression", storedCount: 5, assertedCount: 4, origin: "https://example.com", err: ErrSignCount},
+		{name: "sign count repeated", storedCount: 5, assertedCount: 5, origin: "https://example.com", err: ErrSignCount},
+		{name: "sign count reset to zero", storedCount: 5, assertedCount: 0, origin: "https://example.com", err: ErrSignCount},
+		{name: "wrong origin", storedCount: 1, assertedCount: 2, origin: "https://evil.example", err: ErrInvalidCeremony},
+		{name: "wrong rpIdHash", storedCount: 1, assertedCount: 2, modify: func(a *authenticator) { a.rpID = "evil.example" }, origin: "https://example.com", err: ErrInvalidCeremony},
+		{name: "user not verified", storedCount: 1, assertedCount: 2, modify: func(a *authenticator) { a.flags = flagUserPresent }, origin: "https://example.com", err: ErrInvalidCeremony},
+		{name: "signed by another key", storedCount: 1, assertedCount: 2, origin: "https://example.com", otherKey: true, err: ErrInvalidCeremony},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthenticator(t)
+			credential := Credential{ID: a.credentialID, PublicKey: a.publicKey(), SignCount: tt.storedCount}
+
+			a.signCount = tt.assertedCount
+			if tt.modify != nil {
+				tt.modify(a)
+			}
+
+			key := a.key
+			if tt.otherKey {
+				key = otherKey
+			}
+
+			clientDataJSON, authData, signature := a.get(challenge, tt.origin, key)
+
+			signCount, err := testConfig.VerifyAssertion(challenge, credential, clientDataJSON, authData, signature)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v; want %v", err, tt.err)
+			}
+			if err == nil && signCount != tt.assertedCount {
+				t.Errorf("got sign count %d; want %d", signCount, tt.assertedCount)
+			}
+		})
+	}
+}
+
+// TestRegisterThenLogin runs both ceremonies with the same authenticator, as
+// the handlers do with the stored credential.
+func TestRegisterThenLogin(t *testing.T) {
+	a := newAuthenticator(t)
+
+	clientDataJSON, attestationObject := a.create([]byte("first"), "https://example.com")
+	credential, err := testConfig.VerifyRegistration([]byte("first"), clientDataJSON, attestationObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		a.signCount++
+
+		clientDataJSON, authData, signature := a.get([]byte("second"), "https://example.com", a.key)
+		credential.SignCount, err = testConfig.VerifyAssertion([]byte("second"), *credential, clientDataJSON, authData, signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if credential.SignCount != 3 {
+		t.Errorf("got sign count %d; want 3", credential.SignCount)
+	}
+}
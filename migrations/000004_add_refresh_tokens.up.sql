@@ -0,0 +1,4 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family uuid NOT NULL DEFAULT uuidv7();
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used boolean NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS tokens_user_id_family_idx ON tokens (user_id, family);
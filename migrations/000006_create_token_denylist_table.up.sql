@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS token_denylist (
+  family uuid PRIMARY KEY,
+  expiry timestamp with time zone NOT NULL
+);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS user_identities (
+  id uuid PRIMARY KEY DEFAULT uuidv7(),
+  user_id uuid NOT NULL REFERENCES users ON DELETE CASCADE,
+  provider text NOT NULL,
+  subject text NOT NULL,
+  email citext NOT NULL,
+  created_at timestamp with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+
+CREATE TABLE IF NOT EXISTS oidc_states (
+  hash bytea PRIMARY KEY,
+  provider text NOT NULL,
+  code_verifier text NOT NULL,
+  nonce text NOT NULL,
+  expiry timestamp with time zone NOT NULL
+);
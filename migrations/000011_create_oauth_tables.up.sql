@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS oauth_clients (
+  id uuid PRIMARY KEY DEFAULT uuidv7(),
+  user_id uuid NOT NULL REFERENCES users ON DELETE CASCADE,
+  name text NOT NULL,
+  secret_hash bytea,
+  redirect_uris text[] NOT NULL DEFAULT '{}',
+  scopes text[] NOT NULL DEFAULT '{}',
+  created_at timestamp with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS oauth_clients_user_id_idx ON oauth_clients (user_id);
+
+CREATE TABLE IF NOT EXISTS oauth_codes (
+  hash bytea PRIMARY KEY,
+  client_id uuid NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+  user_id uuid NOT NULL REFERENCES users ON DELETE CASCADE,
+  redirect_uri text NOT NULL,
+  scopes text[] NOT NULL DEFAULT '{}',
+  code_challenge text NOT NULL,
+  expiry timestamp with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS oauth_tokens (
+  hash bytea PRIMARY KEY,
+  kind text NOT NULL,
+  client_id uuid NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+  user_id uuid NOT NULL REFERENCES users ON DELETE CASCADE,
+  scopes text[] NOT NULL DEFAULT '{}',
+  family uuid NOT NULL,
+  used bool NOT NULL DEFAULT false,
+  expiry timestamp with time zone NOT NULL,
+  created_at timestamp with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS oauth_tokens_family_idx ON oauth_tokens (family);
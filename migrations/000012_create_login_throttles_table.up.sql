@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS login_throttles (
+  key text PRIMARY KEY,
+  failures integer NOT NULL DEFAULT 0,
+  lockouts integer NOT NULL DEFAULT 0,
+  locked_until timestamp with time zone,
+  last_failure_at timestamp with time zone NOT NULL
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS email_changes (
+  user_id uuid PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+  old_email citext NOT NULL,
+  new_email citext NOT NULL,
+  confirmed_at timestamp with time zone,
+  expiry timestamp with time zone NOT NULL,
+  created_at timestamp with time zone NOT NULL DEFAULT NOW()
+);
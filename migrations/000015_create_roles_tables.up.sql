@@ -0,0 +1,26 @@
+ALTER TABLE permissions ADD COLUMN IF NOT EXISTS description text NOT NULL DEFAULT '';
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'permissions_code_key') THEN
+    ALTER TABLE permissions ADD CONSTRAINT permissions_code_key UNIQUE (code);
+  END IF;
+END $$;
+
+CREATE TABLE IF NOT EXISTS roles (
+  id uuid PRIMARY KEY DEFAULT uuidv7(),
+  name text UNIQUE NOT NULL,
+  description text NOT NULL DEFAULT '',
+  created_at timestamp with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+  role_id uuid NOT NULL REFERENCES roles ON DELETE CASCADE,
+  permission_id uuid NOT NULL REFERENCES permissions ON DELETE CASCADE,
+  PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+  user_id uuid NOT NULL REFERENCES users ON DELETE CASCADE,
+  role_id uuid NOT NULL REFERENCES roles ON DELETE CASCADE,
+  PRIMARY KEY (user_id, role_id)
+);
@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS organizations (
+  id uuid PRIMARY KEY DEFAULT uuidv7(),
+  name text NOT NULL,
+  slug citext UNIQUE NOT NULL,
+  created_at timestamp with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS organization_members (
+  organization_id uuid NOT NULL REFERENCES organizations ON DELETE CASCADE,
+  user_id uuid NOT NULL REFERENCES users ON DELETE CASCADE,
+  role text NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+  created_at timestamp with time zone NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (organization_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS organization_members_user_id_idx ON organization_members (user_id);
+
+CREATE TABLE IF NOT EXISTS organization_invitations (
+  id uuid PRIMARY KEY DEFAULT uuidv7(),
+  organization_id uuid NOT NULL REFERENCES organizations ON DELETE CASCADE,
+  email citext NOT NULL,
+  role text NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+  hash bytea UNIQUE NOT NULL,
+  invited_by uuid REFERENCES users ON DELETE SET NULL,
+  expiry timestamp with time zone NOT NULL,
+  created_at timestamp with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (organization_id, email)
+);
+
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS organization_id uuid REFERENCES organizations ON DELETE SET NULL;
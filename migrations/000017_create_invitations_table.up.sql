@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS invitations (
+  id uuid PRIMARY KEY DEFAULT uuidv7(),
+  email citext UNIQUE NOT NULL,
+  permissions text[] NOT NULL DEFAULT '{}',
+  hash bytea UNIQUE NOT NULL,
+  invited_by uuid REFERENCES users ON DELETE SET NULL,
+  expiry timestamp with time zone NOT NULL,
+  created_at timestamp with time zone NOT NULL DEFAULT NOW()
+);
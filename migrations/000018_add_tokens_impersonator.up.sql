@@ -0,0 +1 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS impersonator_id uuid REFERENCES users ON DELETE CASCADE;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS audit_events (
+  id uuid PRIMARY KEY DEFAULT uuidv7(),
+  type text NOT NULL,
+  actor_id uuid,
+  impersonator_id uuid,
+  target_id uuid,
+  ip_address text NOT NULL DEFAULT '',
+  user_agent text NOT NULL DEFAULT '',
+  metadata jsonb NOT NULL DEFAULT '{}',
+  created_at timestamp with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_type_idx ON audit_events (type, id);
+CREATE INDEX IF NOT EXISTS audit_events_actor_id_idx ON audit_events (actor_id, id);
+CREATE INDEX IF NOT EXISTS audit_events_target_id_idx ON audit_events (target_id, id);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS login_events (
+  id uuid PRIMARY KEY DEFAULT uuidv7(),
+  user_id uuid NOT NULL REFERENCES users ON DELETE CASCADE,
+  ip_address text NOT NULL,
+  user_agent text NOT NULL,
+  fingerprint text NOT NULL,
+  new_device boolean NOT NULL,
+  created_at timestamp with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS login_events_user_id_idx ON login_events (user_id, id);
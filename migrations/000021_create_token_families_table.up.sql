@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS token_families (
+  family uuid PRIMARY KEY,
+  user_id uuid NOT NULL REFERENCES users ON DELETE CASCADE,
+  expiry timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS token_families_user_id_idx ON token_families (user_id);
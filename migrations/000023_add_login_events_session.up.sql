@@ -0,0 +1 @@
+ALTER TABLE login_events ADD COLUMN IF NOT EXISTS session uuid;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS webauthn_credentials_session_idx;
+ALTER TABLE webauthn_credentials DROP COLUMN IF EXISTS session;
@@ -0,0 +1,4 @@
+ALTER TABLE webauthn_credentials ADD COLUMN IF NOT EXISTS session uuid;
+
+CREATE INDEX IF NOT EXISTS webauthn_credentials_session_idx ON webauthn_credentials (session)
+WHERE session IS NOT NULL;